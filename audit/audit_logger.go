@@ -1,7 +1,9 @@
 package audit
 
 import (
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 )
 
@@ -13,6 +15,23 @@ func AuditLog(message string) {
 	AuditLogger.Println(message)
 }
 
+// TLSIdentity returns the subject of the verified client certificate of a request, or "" without mTLS
+func TLSIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.String()
+}
+
+// RequestSource describes where a request came from for the audit log: the
+// remote address and, when the client presented a certificate, its subject
+func RequestSource(r *http.Request) string {
+	if subject := TLSIdentity(r); subject != "" {
+		return fmt.Sprintf("%s (cert: %s)", r.RemoteAddr, subject)
+	}
+	return r.RemoteAddr
+}
+
 func InitAuditLogger() {
 	file, err := os.OpenFile("/var/log/snh.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
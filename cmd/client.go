@@ -0,0 +1,347 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shadowbq/simple-node-health/audit"
+	"github.com/shadowbq/simple-node-health/oauth"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// ClientInfo is what the client commands show about a client, never its secrets
+type ClientInfo struct {
+	ClientID              string     `json:"client_id"`
+	File                  string     `json:"file"`
+	CreatedAt             string     `json:"created_at,omitempty"`
+	LastUsed              *time.Time `json:"last_used,omitempty"`
+	Scopes                []string   `json:"scopes"`
+	TokenLifetime         string     `json:"token_lifetime,omitempty"`
+	Secret                string     `json:"secret"` // hashed or plaintext
+	PreviousSecretExpires string     `json:"previous_secret_expires,omitempty"`
+}
+
+var (
+	listJSON      bool
+	rotateOverlap time.Duration
+	createScopes  []string
+)
+
+// clientCmd groups the client lifecycle commands
+var clientCmd = &cobra.Command{
+	Use:   "client",
+	Short: "Create, list, describe, rotate and revoke OAuth clients",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		audit.InitAuditLogger()
+	},
+}
+
+var clientCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a new client_id and client_secret and append them to the config file",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		createClient()
+	},
+}
+
+var clientListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the clients with their creation time, last use and scopes",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		clients := loadClientInfo()
+		if listJSON {
+			printJSON(clients)
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CLIENT_ID\tCREATED\tLAST_USED\tSCOPES")
+		for _, client := range clients {
+			lastUsed := "never"
+			if client.LastUsed != nil {
+				lastUsed = client.LastUsed.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", client.ClientID, valueOr(client.CreatedAt, "unknown"), lastUsed, scopeList(client.Scopes))
+		}
+		tw.Flush()
+	},
+}
+
+var clientDescribeCmd = &cobra.Command{
+	Use:   "describe <client_id>",
+	Short: "Show the details of a client",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, client := range loadClientInfo() {
+			if client.ClientID == args[0] {
+				printJSON(client)
+				return
+			}
+		}
+		log.Fatalf("No client with client_id %s", args[0])
+	},
+}
+
+var clientRevokeCmd = &cobra.Command{
+	Use:   "revoke <client_id>",
+	Short: "Remove a client from the config, its tokens stop working immediately",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		clientID := args[0]
+		file := updateClient(clientID, func(clients, client *yaml.Node) error {
+			for i, item := range clients.Content {
+				if item == client {
+					clients.Content = append(clients.Content[:i], clients.Content[i+1:]...)
+					break
+				}
+			}
+			return nil
+		})
+
+		if err := oauth.UpdateClientState(clientStateFile(), clientID, func(*oauth.ClientState) bool { return false }); err != nil {
+			log.Printf("Error removing client state: %v", err)
+		}
+		// Also reject its tokens should the client_id be configured again
+		if err := oauth.RevokeClientTokens(revocationFile(), clientID); err != nil {
+			log.Printf("Error revoking the tokens of the client: %v", err)
+		}
+
+		fmt.Printf("Client %s revoked in %s\n", clientID, file)
+		audit.AuditLog(fmt.Sprintf("Client revoked: client_id: %s in %s at %s", clientID, file, time.Now().Format(time.RFC3339)))
+	},
+}
+
+var clientRotateCmd = &cobra.Command{
+	Use:   "rotate-secret <client_id>",
+	Short: "Replace the client_secret of a client, optionally keeping the old one valid for a while",
+	Long: `Replace the client_secret of a client. With --overlap the previous secret keeps
+working for that long, so the client can be updated without downtime.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		clientID := args[0]
+		secret := oauth.GenerateClientSecret()
+		hash, err := oauth.HashSecret(secret)
+		if err != nil {
+			log.Fatalf("Error hashing client secret: %v", err)
+		}
+
+		var expires string
+		file := updateClient(clientID, func(clients, client *yaml.Node) error {
+			previous := ""
+			if current := mappingValue(client, "client_secret_hash"); current != nil {
+				previous = current.Value
+			} else if plaintext := mappingValue(client, "client_secret"); plaintext != nil {
+				if previous, err = oauth.HashSecret(plaintext.Value); err != nil {
+					return err
+				}
+			}
+
+			setMappingValue(client, "client_secret_hash", hash)
+			deleteMappingKey(client, "client_secret")
+			if rotateOverlap > 0 && previous != "" {
+				expires = time.Now().UTC().Add(rotateOverlap).Format(time.RFC3339)
+				setMappingValue(client, "previous_secret_hash", previous)
+				setMappingValue(client, "previous_secret_expires", expires)
+			} else {
+				deleteMappingKey(client, "previous_secret_hash")
+				deleteMappingKey(client, "previous_secret_expires")
+			}
+			return nil
+		})
+
+		fmt.Printf("New client_secret for %s in %s:\nclient_secret: %s\n", clientID, file, secret)
+		fmt.Println("Store the client_secret now, only its hash is kept and it cannot be shown again.")
+		if expires != "" {
+			fmt.Printf("The previous client_secret keeps working until %s\n", expires)
+		}
+		audit.AuditLog(fmt.Sprintf("Client secret rotated: client_id: %s in %s, previous secret valid until %s at %s", clientID, file, valueOr(expires, "now"), time.Now().Format(time.RFC3339)))
+	},
+}
+
+// Function to create a client in the main config file and print its secret once
+func createClient() {
+	file, err := locateConfigFile()
+	if err != nil {
+		log.Fatalf("Error reading config file: %v", err)
+	}
+	for _, scope := range createScopes {
+		if !slices.Contains(knownScopes(), scope) {
+			log.Fatalf("Unknown scope %q, use one of: %s", scope, strings.Join(knownScopes(), ", "))
+		}
+	}
+
+	clientID, clientSecret := oauth.GenerateClientCredentials()
+	hash, err := oauth.HashSecret(clientSecret)
+	if err != nil {
+		log.Fatalf("Error hashing client secret: %v", err)
+	}
+
+	if _, err := updateConfigFile(file, func(root *yaml.Node) (bool, error) {
+		clients, err := ensureMappingValue(root, "clients", yaml.SequenceNode)
+		if err != nil {
+			return false, err
+		}
+
+		client := &yaml.Node{Kind: yaml.MappingNode}
+		setMappingValue(client, "client_id", clientID)
+		setMappingValue(client, "client_secret_hash", hash)
+		setMappingValue(client, "created_at", time.Now().UTC().Format(time.RFC3339))
+		if len(createScopes) > 0 {
+			scopes := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+			for _, scope := range createScopes {
+				scopes.Content = append(scopes.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: scope})
+			}
+			setMappingNode(client, "scopes", scopes)
+		}
+		clients.Content = append(clients.Content, client)
+		return true, nil
+	}); err != nil {
+		log.Fatalf("Error writing to config file: %v", err)
+	}
+
+	fmt.Printf("New client_id and client_secret added:\nclient_id: %s\nclient_secret: %s\n", clientID, clientSecret)
+	fmt.Println("Store the client_secret now, only its hash is kept and it cannot be shown again.")
+	if len(createScopes) == 0 {
+		fmt.Println("The client has no scopes and may use every route; pass --scope to limit it.")
+	}
+
+	// Log the new client creation
+	audit.AuditLog(fmt.Sprintf("New client created: client_id: %s with scopes [%s] in %s at %s", clientID, scopeList(createScopes), file, time.Now().Format(time.RFC3339)))
+}
+
+// Function to edit the entry of a client in whichever config file defines it, returns the file
+func updateClient(clientID string, edit func(clients, client *yaml.Node) error) string {
+	files := configFiles()
+	for _, file := range files {
+		found := false
+		if _, err := updateConfigFile(file, func(root *yaml.Node) (bool, error) {
+			clients := mappingValue(root, "clients")
+			if clients == nil || clients.Kind != yaml.SequenceNode {
+				return false, nil
+			}
+			for _, client := range clients.Content {
+				if id := mappingValue(client, "client_id"); id != nil && id.Value == clientID {
+					found = true
+					return true, edit(clients, client)
+				}
+			}
+			return false, nil
+		}); err != nil {
+			log.Fatalf("Error writing to config file %s: %v", file, err)
+		}
+		if found {
+			return file
+		}
+	}
+
+	log.Fatalf("No client with client_id %s in %s", clientID, strings.Join(files, ", "))
+	return ""
+}
+
+// Function to read every client from the config files with its recorded state
+func loadClientInfo() []ClientInfo {
+	files := configFiles()
+	state, err := oauth.LoadClientState(clientStateFile())
+	if err != nil {
+		log.Printf("Error reading client state: %v", err)
+	}
+
+	var infos []ClientInfo
+	for _, file := range files {
+		v := viper.New()
+		v.SetConfigFile(file)
+		v.SetConfigType("yaml")
+		if err := v.ReadInConfig(); err != nil {
+			log.Fatalf("Error reading config file: %v", err)
+		}
+		var clients []Client
+		if err := v.UnmarshalKey("clients", &clients); err != nil {
+			log.Fatalf("Error parsing clients in %s: %v", file, err)
+		}
+
+		for _, client := range clients {
+			info := ClientInfo{
+				ClientID:              client.ClientID,
+				File:                  file,
+				CreatedAt:             client.CreatedAt,
+				Scopes:                append([]string{}, client.Scopes...),
+				Secret:                "hashed",
+				PreviousSecretExpires: client.PreviousSecretExpires,
+			}
+			if client.TokenLifetime > 0 {
+				info.TokenLifetime = client.TokenLifetime.String()
+			}
+			if client.ClientSecretHash == "" {
+				info.Secret = "plaintext"
+			}
+			if s, ok := state[client.ClientID]; ok {
+				lastUsed := s.LastUsed
+				info.LastUsed = &lastUsed
+			}
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// Function to list the main config file and its fragments
+func configFiles() []string {
+	file, err := locateConfigFile()
+	if err != nil {
+		log.Fatalf("Error reading config file: %v", err)
+	}
+	// The state file location comes from the config
+	if _, err := readConfigFiles(viper.GetViper(), file); err != nil {
+		log.Fatalf("Error reading config file: %v", err)
+	}
+
+	fragments, err := configFragments(file)
+	if err != nil {
+		log.Fatalf("Error reading config fragments: %v", err)
+	}
+	return append([]string{file}, fragments...)
+}
+
+// Function to print a value as indented JSON
+func printJSON(value interface{}) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Fatalf("Error encoding JSON: %v", err)
+	}
+	fmt.Println(string(data))
+}
+
+// Function to show the scopes of a client, no scopes means unrestricted
+func scopeList(scopes []string) string {
+	if len(scopes) == 0 {
+		return "*"
+	}
+	return strings.Join(scopes, ",")
+}
+
+// Function to use a fallback for empty values
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func init() {
+	clientListCmd.Flags().BoolVar(&listJSON, "json", false, "Print the clients as JSON")
+	clientCreateCmd.Flags().StringSliceVar(&createScopes, "scope", nil, "Scope granted to the client, repeat or separate with commas (default every route)")
+	clientRotateCmd.Flags().DurationVar(&rotateOverlap, "overlap", 0, "How long the previous secret keeps working, e.g. 24h")
+
+	clientCmd.AddCommand(clientCreateCmd, clientListCmd, clientDescribeCmd, clientRevokeCmd, clientRotateCmd)
+	rootCmd.AddCommand(clientCmd)
+}
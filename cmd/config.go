@@ -1,55 +1,375 @@
 package cmd
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/shadowbq/simple-node-health/oauth"
+	"github.com/shadowbq/simple-node-health/parsers"
+	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-var (
-	authTokenSecret   string
-	ClientsFromConfig []Client
-)
+type Client = oauth.Client
+
+// Function to locate and read the config file and its fragments into Viper
+func readConfigFile() (*configContent, error) {
+	file, err := locateConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := readConfigContent(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadGlobalConfig(content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
 
-type Client struct {
-	ClientID     string `mapstructure:"client_id"`
-	ClientSecret string `mapstructure:"client_secret"`
+// Function to load config content into the global Viper instance
+func loadGlobalConfig(content *configContent) error {
+	sources, err := content.load(viper.GetViper())
+	if err != nil {
+		return err
+	}
+
+	configSourcesMu.Lock()
+	configSources = sources
+	configSourcesMu.Unlock()
+	return nil
+}
+
+// Function to create a Viper instance with the defaults, flags and environment of
+// the global one, for a config that is validated before it is put in use
+func newConfig() *viper.Viper {
+	v := viper.New()
+	setDefaults(v)
+	for key, flag := range configFlags {
+		v.BindPFlag(key, flag)
+	}
+	v.AutomaticEnv()
+	return v
+}
+
+// Function to load check settings for the CLI checks, which run without
+// credentials so a missing config file only falls back to the defaults
+func initCheckConfig() {
+	if _, err := readConfigFile(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			log.Fatalf("Error reading config file: %v", err)
+		}
+	}
 }
 
 // Function to initialize the configuration for Viper
 func initConfig() {
-	viper.SetConfigName("snh-config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".")
+	if err := loadConfig(); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
 
-	// Add /usr/local/etc as an additional search path
-	viper.AddConfigPath("/usr/local/etc")
+// Function to read the config file and load the client credentials and token secret
+func loadConfig() error {
+	content, err := readConfigFile()
+	if err != nil {
+		return fmt.Errorf("Error reading config file: %v", err)
+	}
 
-	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("Error reading config file: %v", err)
+	settings, err := validateConfig(viper.GetViper(), content)
+	if err != nil {
+		return err
 	}
+	return applyConfig(viper.GetViper(), settings)
+}
 
+// Function to put a validated config in use by the token endpoints and the checks
+func applyConfig(v *viper.Viper, settings oauth.Settings) error {
+	// Checks read a copy, a check still running after a reload never sees the config change under it
+	snapshot := viper.New()
+	if err := snapshot.MergeConfigMap(v.AllSettings()); err != nil {
+		return fmt.Errorf("Error copying config: %v", err)
+	}
+
+	oauth.Configure(settings)
+	parsers.SetConfig(snapshot)
+	return nil
+}
+
+// Function to validate a config and return its token settings. The content it was
+// loaded from is checked against the schema first, warnings are logged and errors are fatal.
+func validateConfig(v *viper.Viper, content *configContent) (oauth.Settings, error) {
+	if content != nil {
+		issues, err := content.check()
+		if err != nil {
+			return oauth.Settings{}, err
+		}
+
+		var errs []string
+		for _, issue := range issues {
+			if issue.Warning {
+				log.Printf("Config %s", issue)
+			} else {
+				errs = append(errs, issue.String())
+			}
+		}
+		if len(errs) > 0 {
+			return oauth.Settings{}, fmt.Errorf("Invalid config:\n%s", strings.Join(errs, "\n"))
+		}
+	}
+
+	return validateSettings(v)
+}
+
+// Function to validate the settings of a config and return its token settings. Every section that is
+// read at runtime is checked so a reload never swaps in a config that fails later.
+func validateSettings(v *viper.Viper) (oauth.Settings, error) {
 	// Load client credentials into the Clients slice
-	if err := viper.UnmarshalKey("clients", &ClientsFromConfig); err != nil {
-		log.Fatalf("Error parsing client configuration: %v", err)
+	var clients []Client
+	if err := v.UnmarshalKey("clients", &clients); err != nil {
+		return oauth.Settings{}, fmt.Errorf("Error parsing client configuration: %v", err)
 	}
 
 	// log the clients size
-	log.Printf("Clients size from Config: %d", len(ClientsFromConfig))
+	log.Printf("Clients size from Config: %d", len(clients))
 
-	if len(ClientsFromConfig) == 0 {
+	if len(clients) == 0 {
 		log.Printf("No clients found. ")
 
 		// Check if insecure mode is enabled in the config
-		if viper.GetBool("insecure") {
+		if v.GetBool("insecure") {
 			log.Println("Insecure mode enabled. No client credentials required.")
 		} else {
-			log.Println("Either enable insecure mode, or run: 'simple-node-health create-client'")
-			os.Exit(1)
+			return oauth.Settings{}, fmt.Errorf("Either enable insecure mode, or run: 'simple-node-health create-client'")
 		}
 	} // Verbose logging
 
-	// Load token secret
-	authTokenSecret = viper.GetString("authTokenSecret")
+	// The schema catches duplicates within a file, this catches them across fragments
+	clientIDs := map[string]bool{}
+	var plaintext []string
+	for i, client := range clients {
+		if client.ClientID == "" || (client.ClientSecret == "") == (client.ClientSecretHash == "") {
+			return oauth.Settings{}, fmt.Errorf("Client %d needs a client_id and either a client_secret_hash or a client_secret", i)
+		}
+		if clientIDs[client.ClientID] {
+			return oauth.Settings{}, fmt.Errorf("Duplicate client_id %q", client.ClientID)
+		}
+		clientIDs[client.ClientID] = true
+		if client.TokenLifetime < 0 {
+			return oauth.Settings{}, fmt.Errorf("Client %s has a negative token_lifetime", client.ClientID)
+		}
+
+		if client.ClientSecretHash == "" {
+			plaintext = append(plaintext, client.ClientID)
+		}
+	}
+	if len(plaintext) > 0 {
+		log.Printf("Warning: clients %s have a plaintext client_secret, run 'simple-node-health migrate-secrets' to hash them", strings.Join(plaintext, ", "))
+	}
+
+	keys, err := loadKeySet(v)
+	if err != nil {
+		return oauth.Settings{}, fmt.Errorf("Error in signing keys: %v", err)
+	}
+
+	if v.GetDuration("tokens.lifetime") <= 0 || v.GetDuration("tokens.leeway") < 0 {
+		return oauth.Settings{}, fmt.Errorf("Error in tokens: lifetime must be positive and leeway not negative")
+	}
+
+	rateLimit := oauth.RateLimit{
+		RequestsPerMinute: v.GetInt("rate_limit.requests_per_minute"),
+		MaxFailures:       v.GetInt("rate_limit.max_failures"),
+		Lockout:           v.GetDuration("rate_limit.lockout"),
+		MaxLockout:        v.GetDuration("rate_limit.max_lockout"),
+	}
+	for _, proxy := range v.GetStringSlice("rate_limit.trusted_proxies") {
+		network, err := parseNetwork(proxy)
+		if err != nil {
+			return oauth.Settings{}, fmt.Errorf("Error in rate_limit.trusted_proxies: %v", err)
+		}
+		rateLimit.TrustedProxies = append(rateLimit.TrustedProxies, network)
+	}
+	if rateLimit.RequestsPerMinute < 0 || rateLimit.MaxFailures < 0 {
+		return oauth.Settings{}, fmt.Errorf("Error in rate_limit: requests_per_minute and max_failures must not be negative")
+	}
+	if rateLimit.MaxFailures > 0 && (rateLimit.Lockout <= 0 || rateLimit.MaxLockout < rateLimit.Lockout) {
+		return oauth.Settings{}, fmt.Errorf("Error in rate_limit: lockout must be positive and max_lockout at least lockout")
+	}
+
+	if port := v.GetInt("port"); port < 1 || port > 65535 {
+		return oauth.Settings{}, fmt.Errorf("Invalid port %d", port)
+	}
+
+	if err := parsers.ValidateConfig(v); err != nil {
+		return oauth.Settings{}, fmt.Errorf("Error in check configuration: %v", err)
+	}
+
+	for _, state := range []parsers.State{parsers.StatePass, parsers.StateWarn, parsers.StateFail} {
+		if code := v.GetInt("http_status." + string(state)); code < 100 || code > 599 {
+			return oauth.Settings{}, fmt.Errorf("Error in http_status.%s: %d is not an HTTP status code", state, code)
+		}
+	}
+
+	if settings, enabled := loadTLSSettings(v); enabled {
+		if _, err := newCertReloader(settings); err != nil {
+			return oauth.Settings{}, fmt.Errorf("Error in TLS configuration: %v", err)
+		}
+	}
+
+	issuer, err := issuerIdentifier(v)
+	if err != nil {
+		return oauth.Settings{}, err
+	}
+
+	return oauth.Settings{
+		Clients:        clients,
+		Keys:           keys,
+		Scopes:         knownScopes(),
+		Issuer:         issuer,
+		Audience:       v.GetString("tokens.audience"),
+		Lifetime:       v.GetDuration("tokens.lifetime"),
+		Leeway:         v.GetDuration("tokens.leeway"),
+		StateFile:      filepath.Join(v.GetString("state_dir"), "clients.json"),
+		RevocationFile: filepath.Join(v.GetString("state_dir"), "revoked.json"),
+		RateLimit:      rateLimit,
+	}, nil
+}
+
+// Function to parse a CIDR, or a single IP address as a network of one address
+func parseNetwork(value string) (*net.IPNet, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+// Function to get the issuer of the tokens: the configured issuer, else the URL of
+// this host and port so every node has its own. Never taken from a request.
+func issuerIdentifier(v *viper.Viper) (string, error) {
+	if configured := v.GetString("issuer"); configured != "" {
+		return strings.TrimSuffix(configured, "/"), nil
+	}
+
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "", fmt.Errorf("Error in issuer: the host name is unknown, configure issuer")
+	}
+	scheme := "http"
+	if _, enabled := loadTLSSettings(v); enabled {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, host, v.GetInt("port")), nil
+}
+
+// Function to load the token signing keys of a config. A usable signing key is
+// required unless insecure mode is enabled and no key is configured at all.
+func loadKeySet(v *viper.Viper) (*oauth.KeySet, error) {
+	var configs []oauth.KeyConfig
+	if err := v.UnmarshalKey("signing.keys", &configs); err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 && v.GetString("authTokenSecret") == "" && v.GetBool("insecure") {
+		return nil, nil
+	}
+
+	// Key files are relative to the config file
+	for i := range configs {
+		if configs[i].File != "" && !filepath.IsAbs(configs[i].File) {
+			configs[i].File = filepath.Join(filepath.Dir(v.ConfigFileUsed()), configs[i].File)
+		}
+	}
+	return oauth.LoadKeySet(configs, v.GetString("authTokenSecret"))
+}
+
+// Function to get the file where the server records client usage
+func clientStateFile() string {
+	return filepath.Join(viper.GetString("state_dir"), "clients.json")
+}
+
+// Function to get the revocation file of the global config
+func revocationFile() string {
+	return filepath.Join(viper.GetString("state_dir"), "revoked.json")
+}
+
+// configCmd groups the commands that work on the config file
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect and validate the config file",
+}
+
+// configValidateCmd checks a config file without starting the server
+var configValidateCmd = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Validate the config file, exits non-zero when it has errors",
+	Long: `Validate the config file and its fragments against the schema and check every
+setting the server would load. Defaults to the config file the server would use.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(validateConfigFile(args))
+	},
+}
+
+// Function to validate a config file and print the issues, returns the exit code
+func validateConfigFile(args []string) int {
+	if len(args) > 0 {
+		configFile = args[0]
+	}
+	file, err := locateConfigFile()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading config file: %v\n", err)
+		return 1
+	}
+
+	candidate := newConfig()
+	if _, err := readConfigFiles(candidate, file); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: error: %v\n", file, err)
+		return 1
+	}
+
+	issues, err := checkConfigFiles(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: error: %v\n", file, err)
+		return 1
+	}
+
+	errors, warnings := 0, 0
+	for _, issue := range issues {
+		fmt.Println(issue)
+		if issue.Warning {
+			warnings++
+		} else {
+			errors++
+		}
+	}
+
+	// Settings are only checked as a whole once the file itself is valid
+	if errors == 0 {
+		if _, err := validateSettings(candidate); err != nil {
+			fmt.Printf("%s: error: %v\n", file, err)
+			errors++
+		}
+	}
+
+	if errors > 0 {
+		fmt.Printf("%s: %d error(s), %d warning(s)\n", file, errors, warnings)
+		return 1
+	}
+	fmt.Printf("%s: OK, %d warning(s)\n", file, warnings)
+	return 0
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
 }
@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// configName is the base name of the main config file in the search paths
+const configName = "snh-config"
+
+// configSearchPaths are searched in order when no config file is given
+var configSearchPaths = []string{".", "/etc/snh", "/usr/local/etc"}
+
+// appendedLists are the lists whose entries from every config file are kept, other values are replaced
+var appendedLists = []string{"clients", "disks.rules", "disks.overrides", "dns.probes"}
+
+var (
+	configFile string // --config flag
+	configDir  string // --config-dir flag
+
+	// configSources maps each dotted key of the global config to the files that set it
+	configSources   map[string][]string
+	configSourcesMu sync.RWMutex
+)
+
+// Function to find the main config file: --config, then $SNH_CONFIG, then the search paths
+func locateConfigFile() (string, error) {
+	if configFile != "" {
+		return configFile, nil
+	}
+	if file := os.Getenv("SNH_CONFIG"); file != "" {
+		return file, nil
+	}
+
+	for _, dir := range configSearchPaths {
+		for _, ext := range []string{"yaml", "yml"} {
+			file := filepath.Join(dir, configName+"."+ext)
+			if _, err := os.Stat(file); err == nil {
+				return file, nil
+			}
+		}
+	}
+	return "", viper.ConfigFileNotFoundError{}
+}
+
+// Function to get the fragment directory of a config file: --config-dir, then
+// $SNH_CONFIG_DIR, then snh-config.d next to the main file
+func fragmentDir(file string) string {
+	if configDir != "" {
+		return configDir
+	}
+	if dir := os.Getenv("SNH_CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(filepath.Dir(file), configName+".d")
+}
+
+// Function to list the YAML fragments of a config file in lexical order, a missing directory has none
+func configFragments(file string) ([]string, error) {
+	entries, err := os.ReadDir(fragmentDir(file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fragments []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		fragments = append(fragments, filepath.Join(fragmentDir(file), entry.Name()))
+	}
+	sort.Strings(fragments)
+	return fragments, nil
+}
+
+// configContent is a main config file and its fragments as read from disk, so a
+// validated config can be loaded again without reading the files a second time
+type configContent struct {
+	file      string
+	data      []byte
+	fragments []configFragment
+}
+
+// configFragment is a fragment file of a configContent
+type configFragment struct {
+	file string
+	data []byte
+}
+
+// Function to read the main config file and its fragments
+func readConfigContent(file string) (*configContent, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	content := &configContent{file: file, data: data}
+
+	fragments, err := configFragments(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, fragment := range fragments {
+		data, err := os.ReadFile(fragment)
+		if err != nil {
+			return nil, err
+		}
+		content.fragments = append(content.fragments, configFragment{file: fragment, data: data})
+	}
+	return content, nil
+}
+
+// Function to read the main config file and merge its fragments into a Viper
+// instance. Returns the files that set each dotted key.
+func readConfigFiles(v *viper.Viper, file string) (map[string][]string, error) {
+	content, err := readConfigContent(file)
+	if err != nil {
+		return nil, err
+	}
+	return content.load(v)
+}
+
+// Function to load the main file and merge the fragments into a Viper instance,
+// replacing the settings it read before. Returns the files that set each dotted key.
+func (c *configContent) load(v *viper.Viper) (map[string][]string, error) {
+	v.SetConfigFile(c.file)
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(c.data)); err != nil {
+		return nil, err
+	}
+
+	sources := map[string][]string{}
+	main, err := parseYAMLMap(c.file, c.data)
+	if err != nil {
+		return nil, err
+	}
+	recordSources(sources, main, c.file)
+
+	for _, f := range c.fragments {
+		fragment := f.file
+		settings, err := parseYAMLMap(fragment, f.data)
+		if err != nil {
+			return nil, err
+		}
+
+		// Keep the entries of lists already set by an earlier file
+		for _, key := range appendedLists {
+			added, ok := lookupKey(settings, key).([]interface{})
+			if !ok || !v.InConfig(key) {
+				continue
+			}
+			if existing, ok := v.Get(key).([]interface{}); ok {
+				setKey(settings, key, append(append([]interface{}{}, existing...), added...))
+			}
+		}
+
+		if err := v.MergeConfigMap(settings); err != nil {
+			return nil, fmt.Errorf("merging %s: %v", fragment, err)
+		}
+		recordSources(sources, settings, fragment)
+	}
+
+	return sources, nil
+}
+
+// Function to read a YAML file into a map with lower case keys like Viper
+func readYAMLMap(file string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseYAMLMap(file, data)
+}
+
+// Function to parse the YAML of a file into a map with lower case keys like Viper
+func parseYAMLMap(file string, data []byte) (map[string]interface{}, error) {
+	settings := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", file, err)
+	}
+	return lowerKeys(settings), nil
+}
+
+// Function to lower case the keys of nested maps
+func lowerKeys(settings map[string]interface{}) map[string]interface{} {
+	lowered := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = lowerKeys(nested)
+		}
+		lowered[strings.ToLower(key)] = value
+	}
+	return lowered
+}
+
+// Function to get a dotted key from nested maps
+func lookupKey(settings map[string]interface{}, key string) interface{} {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		nested, ok := settings[part].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		settings = nested
+	}
+	return settings[parts[len(parts)-1]]
+}
+
+// Function to set a dotted key that already exists in nested maps
+func setKey(settings map[string]interface{}, key string, value interface{}) {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		settings = settings[part].(map[string]interface{})
+	}
+	settings[parts[len(parts)-1]] = value
+}
+
+// Function to record the file as the source of every key it sets. Appended
+// lists keep every file that contributed entries, other keys the last one.
+func recordSources(sources map[string][]string, settings map[string]interface{}, file string) {
+	for key := range flattenSettings("", settings) {
+		appended := false
+		for _, list := range appendedLists {
+			appended = appended || key == list
+		}
+		if appended {
+			sources[key] = append(sources[key], file)
+		} else {
+			sources[key] = []string{file}
+		}
+	}
+}
+
+// Function to describe where the effective value of a key in the global config comes from
+func configSource(key string) string {
+	if flag := rootCmd.PersistentFlags().Lookup(key); flag != nil && flag.Changed {
+		return "flag --" + key
+	}
+	if flag := rootCmd.Flags().Lookup(key); flag != nil && flag.Changed {
+		return "flag --" + key
+	}
+	if _, ok := os.LookupEnv(strings.ToUpper(key)); ok {
+		return "env " + strings.ToUpper(key)
+	}
+
+	configSourcesMu.RLock()
+	defer configSourcesMu.RUnlock()
+	if files, ok := configSources[key]; ok {
+		return strings.Join(files, ", ")
+	}
+	return "default"
+}
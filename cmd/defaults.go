@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"github.com/shadowbq/simple-node-health/parsers"
+	"github.com/spf13/viper"
+)
+
+// Function to set the config defaults on a Viper instance. Besides the global
+// instance this is used for the candidate config validated before a reload.
+func setDefaults(v *viper.Viper) {
+	// Same default as the --domain flag
+	v.SetDefault("domain", "cloudflare.com")
+
+	// Same default as the --port flag
+	v.SetDefault("port", 8080)
+
+	// Client usage and other state written by the server
+	v.SetDefault("state_dir", "/var/lib/snh")
+
+	// Issued tokens are valid for an hour, clocks may be 30s apart
+	v.SetDefault("tokens.lifetime", "1h")
+	v.SetDefault("tokens.leeway", "30s")
+
+	// Client authentication limits: 60 requests a minute per source IP, lockouts
+	// after 5 failures from 1m doubling up to 1h
+	v.SetDefault("rate_limit.requests_per_minute", 60)
+	v.SetDefault("rate_limit.max_failures", 5)
+	v.SetDefault("rate_limit.lockout", "1m")
+	v.SetDefault("rate_limit.max_lockout", "1h")
+
+	// Reload the config file when it changes
+	v.SetDefault("watch_config", true)
+
+	// Disk check defaults: read-only EXT4 mounts from the kernel mount table
+	v.SetDefault("disks.mountinfo", parsers.DefaultMountInfoPath)
+	v.SetDefault("disks.fstypes", []string{"ext4"})
+	v.SetDefault("disks.rules", parsers.DefaultDiskRules)
+	v.SetDefault("disks.thresholds.space.warning", 85)
+	v.SetDefault("disks.thresholds.space.critical", 95)
+	v.SetDefault("disks.thresholds.inodes.warning", 85)
+	v.SetDefault("disks.thresholds.inodes.critical", 95)
+
+	// DNS check defaults: A records from the system resolvers
+	v.SetDefault("dns.type", "A")
+	v.SetDefault("dns.timeout", "2s")
+	v.SetDefault("dns.resolv_conf", parsers.DefaultResolvConf)
+
+	// Aggregate check defaults: every check enabled with a 10s timeout each,
+	// forced runs of scheduled checks at most every 10s
+	v.SetDefault("checks.timeout", "10s")
+	v.SetDefault("checks.fresh_min_interval", "10s")
+	for _, check := range parsers.Checks() {
+		v.SetDefault("checks."+check.Name()+".enabled", true)
+	}
+
+	// Metrics route enabled and protected by default
+	v.SetDefault("metrics.enabled", true)
+	v.SetDefault("metrics.public", false)
+
+	// TLS is enabled by setting tls.cert and tls.key
+	v.SetDefault("tls.min_version", "1.2")
+	v.SetDefault("tls.client_auth", "require")
+
+	// HTTP server timeouts, checks can take up to checks.timeout to respond
+	v.SetDefault("server.read_timeout", "10s")
+	v.SetDefault("server.read_header_timeout", "5s")
+	v.SetDefault("server.write_timeout", "30s")
+	v.SetDefault("server.idle_timeout", "60s")
+	v.SetDefault("server.shutdown_timeout", "15s")
+
+	// HTTP status codes returned by the check endpoints for each state
+	for state, code := range parsers.DefaultHTTPStatus {
+		v.SetDefault("http_status."+string(state), code)
+	}
+}
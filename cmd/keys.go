@@ -0,0 +1,242 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shadowbq/simple-node-health/audit"
+	"github.com/shadowbq/simple-node-health/oauth"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	rotateAlgorithm string
+	rotatePrune     bool
+)
+
+// keysCmd groups the signing key commands
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "List and rotate the keys tokens are signed with",
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the signing keys, the active key signs new tokens and every key verifies",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		configFiles()
+		keys, err := loadKeySet(viper.GetViper())
+		if err != nil {
+			log.Fatalf("Error in signing keys: %v", err)
+		}
+		if keys == nil {
+			fmt.Println("No signing keys configured.")
+			return
+		}
+
+		var configs []oauth.KeyConfig
+		if err := viper.UnmarshalKey("signing.keys", &configs); err != nil {
+			log.Fatalf("Error parsing signing keys: %v", err)
+		}
+		sources := map[string]string{}
+		for _, cfg := range configs {
+			sources[cfg.ID] = valueOr(cfg.File, "inline secret")
+		}
+
+		var kids []string
+		for kid := range keys.Keys {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KID\tALGORITHM\tACTIVE\tSOURCE")
+		for _, kid := range kids {
+			fmt.Fprintf(tw, "%s\t%s\t%t\t%s\n", kid, keys.Keys[kid].Algorithm, keys.Active.ID == kid, valueOr(sources[kid], "authTokenSecret"))
+		}
+		tw.Flush()
+	},
+}
+
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Generate a new active signing key, the previous keys keep verifying tokens",
+	Long: `Generate a new signing key in signing.key_dir and make it the active key. The
+previous active key stays configured to verify the tokens it already signed;
+remove it once they have expired, or pass --prune on the next rotation.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		files := configFiles()
+		audit.InitAuditLogger()
+
+		algorithm := rotateAlgorithm
+		previous := "none"
+		if keys, err := loadKeySet(viper.GetViper()); err == nil && keys != nil {
+			previous = keys.Active.ID
+			if algorithm == "" {
+				algorithm = keys.Active.Algorithm
+			}
+		}
+		if algorithm == "" {
+			algorithm = oauth.AlgES256
+		}
+
+		material, err := oauth.GenerateKey(algorithm)
+		if err != nil {
+			log.Fatalf("Error generating key: %v", err)
+		}
+
+		suffix := make([]byte, 3)
+		if _, err := rand.Read(suffix); err != nil {
+			log.Fatalf("Error generating kid: %v", err)
+		}
+		kid := time.Now().UTC().Format("20060102") + "-" + hex.EncodeToString(suffix)
+
+		keyDir := viper.GetString("signing.key_dir")
+		if keyDir == "" {
+			keyDir = filepath.Join(filepath.Dir(files[0]), "keys")
+		}
+		keyDir, err = filepath.Abs(keyDir)
+		if err != nil {
+			log.Fatalf("Error resolving key directory: %v", err)
+		}
+		ext := ".pem"
+		if algorithm == oauth.AlgHS256 {
+			ext = ".key"
+		}
+		keyFile := filepath.Join(keyDir, kid+ext)
+		file := signingKeysFile(files)
+		if err := writeKeyFile(keyFile, material, file); err != nil {
+			log.Fatalf("Error writing key: %v", err)
+		}
+
+		// Check the new key loads before it is put in the config
+		if _, err := oauth.LoadKeySet([]oauth.KeyConfig{{ID: kid, Algorithm: algorithm, File: keyFile, Active: true}}, ""); err != nil {
+			log.Fatalf("Error loading the new key: %v", err)
+		}
+
+		var pruned []string
+		if _, err := updateConfigFile(file, func(root *yaml.Node) (bool, error) {
+			signing, err := ensureMappingValue(root, "signing", yaml.MappingNode)
+			if err != nil {
+				return false, err
+			}
+			keys, err := ensureMappingValue(signing, "keys", yaml.SequenceNode)
+			if err != nil {
+				return false, err
+			}
+
+			// Demote the active key, with --prune drop the keys that were already inactive
+			var kept []*yaml.Node
+			for _, key := range keys.Content {
+				active := mappingValue(key, "active")
+				if rotatePrune && len(keys.Content) > 1 && (active == nil || active.Value != "true") {
+					if id := mappingValue(key, "kid"); id != nil {
+						pruned = append(pruned, id.Value)
+					}
+					continue
+				}
+				setMappingNode(key, "active", boolNode(false))
+				kept = append(kept, key)
+			}
+
+			key := &yaml.Node{Kind: yaml.MappingNode}
+			setMappingValue(key, "kid", kid)
+			setMappingValue(key, "algorithm", algorithm)
+			setMappingValue(key, "file", keyFile)
+			setMappingNode(key, "active", boolNode(true))
+			keys.Content = append(kept, key)
+			return true, nil
+		}); err != nil {
+			os.Remove(keyFile)
+			log.Fatalf("Error writing to config file %s: %v", file, err)
+		}
+
+		fmt.Printf("New active %s signing key %s in %s, written to %s\n", algorithm, kid, keyFile, file)
+		if previous != "none" {
+			fmt.Printf("The previous key %s keeps verifying the tokens it signed until it is removed\n", previous)
+		}
+		for _, id := range pruned {
+			fmt.Printf("Removed inactive key %s from the config, delete its key file if it is no longer needed\n", id)
+		}
+		audit.AuditLog(fmt.Sprintf("Signing key rotated: %s %s active, previous key %s, pruned [%s] at %s", algorithm, kid, previous, strings.Join(pruned, ", "), time.Now().Format(time.RFC3339)))
+	},
+}
+
+// Function to find the config file that defines the signing keys, by default the main file
+func signingKeysFile(files []string) string {
+	for _, file := range files {
+		settings, err := readYAMLMap(file)
+		if err == nil && lookupKey(settings, "signing.keys") != nil {
+			return file
+		}
+	}
+	return files[0]
+}
+
+// Function to write a new key file readable by the owner and group of the config
+// file that references it, so the service can load it after a rotation run as root
+func writeKeyFile(path string, material []byte, configFile string) error {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+	uid, gid := os.Geteuid(), os.Getegid()
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid, gid = int(st.Uid), int(st.Gid)
+	}
+	chown := func(name string) error {
+		if uid == os.Geteuid() && gid == os.Getegid() {
+			return nil
+		}
+		if err := os.Chown(name, uid, gid); err != nil {
+			return fmt.Errorf("%s is owned by %d:%d, run as that user: %v", configFile, uid, gid, err)
+		}
+		return nil
+	}
+
+	dir := filepath.Dir(path)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return err
+		}
+		if err := chown(dir); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	if err := chown(path); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if _, err := f.Write(material); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func init() {
+	keysRotateCmd.Flags().StringVar(&rotateAlgorithm, "algorithm", "", "Algorithm of the new key: HS256, RS256, ES256 or EdDSA (default the algorithm of the active key, or ES256)")
+	keysRotateCmd.Flags().BoolVar(&rotatePrune, "prune", false, "Remove the keys that were already inactive before this rotation")
+
+	keysCmd.AddCommand(keysListCmd, keysRotateCmd)
+	rootCmd.AddCommand(keysCmd)
+}
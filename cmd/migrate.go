@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/shadowbq/simple-node-health/audit"
+	"github.com/shadowbq/simple-node-health/oauth"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// migrateSecretsCmd replaces the plaintext client secrets in the config files with their hashes
+var migrateSecretsCmd = &cobra.Command{
+	Use:   "migrate-secrets",
+	Short: "Replace plaintext client_secret entries in the config files with client_secret_hash",
+	Long: `Replace every plaintext client_secret in the config file and its fragments with a
+bcrypt client_secret_hash, in place. Clients keep using the same secret.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		file, err := locateConfigFile()
+		if err != nil {
+			log.Fatalf("Error reading config file: %v", err)
+		}
+		fragments, err := configFragments(file)
+		if err != nil {
+			log.Fatalf("Error reading config fragments: %v", err)
+		}
+		audit.InitAuditLogger()
+
+		for _, f := range append([]string{file}, fragments...) {
+			var migrated []string
+			if _, err := updateConfigFile(f, func(root *yaml.Node) (bool, error) {
+				var err error
+				migrated, err = hashClientSecrets(root)
+				return len(migrated) > 0, err
+			}); err != nil {
+				log.Fatalf("Error migrating %s: %v", f, err)
+			}
+			if len(migrated) == 0 {
+				continue
+			}
+
+			fmt.Printf("%s: hashed the client_secret of %d client(s)\n", f, len(migrated))
+			for _, clientID := range migrated {
+				audit.AuditLog(fmt.Sprintf("Client secret hashed: client_id: %s in %s", clientID, f))
+			}
+		}
+	},
+}
+
+// Function to replace the plaintext secrets of the clients in a config with their hashes
+func hashClientSecrets(root *yaml.Node) ([]string, error) {
+	clients := mappingValue(root, "clients")
+	if clients == nil || clients.Kind != yaml.SequenceNode {
+		return nil, nil
+	}
+
+	var migrated []string
+	for _, client := range clients.Content {
+		if client.Kind != yaml.MappingNode {
+			continue
+		}
+		secret := mappingValue(client, "client_secret")
+		if secret == nil || secret.Value == "" || mappingValue(client, "client_secret_hash") != nil {
+			continue
+		}
+
+		hash, err := oauth.HashSecret(secret.Value)
+		if err != nil {
+			return nil, err
+		}
+		setMappingValue(client, "client_secret_hash", hash)
+		deleteMappingKey(client, "client_secret")
+
+		clientID := "(no client_id)"
+		if id := mappingValue(client, "client_id"); id != nil {
+			clientID = id.Value
+		}
+		migrated = append(migrated, clientID)
+	}
+	return migrated, nil
+}
+
+func init() {
+	rootCmd.AddCommand(migrateSecretsCmd)
+}
@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/shadowbq/simple-node-health/audit"
+	"github.com/shadowbq/simple-node-health/oauth"
+	"github.com/shadowbq/simple-node-health/parsers"
+	"github.com/spf13/viper"
+)
+
+var (
+	// activeHandler is the handler served by the running server, replaced when the config is reloaded
+	activeHandler atomic.Value
+
+	// reloadMu serializes reloads. Requests take no lock: the handler is swapped
+	// atomically and checks and tokens read settings snapshots, never global viper.
+	reloadMu sync.Mutex
+)
+
+// reloadableHandler serves requests with the current activeHandler
+type reloadableHandler struct{}
+
+func (reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	activeHandler.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// restartSettings are the prefixes of the settings only read when the server
+// starts, a reload records their changes but cannot apply them
+var restartSettings = []string{"port.", "watch_config.", "server.", "tls."}
+
+// Function to re-read the config file and swap in the new clients, token
+// secret, check settings and routes. The files are read once and validated on
+// their own Viper instance; an invalid config is rejected and the running one
+// kept, a valid one is loaded from the same content, never read again.
+func reloadConfig(reason string) {
+	candidate := newConfig()
+
+	var settings oauth.Settings
+	content, err := readConfigContent(viper.ConfigFileUsed())
+	if err == nil {
+		_, err = content.load(candidate)
+	}
+	if err == nil {
+		settings, err = validateConfig(candidate, content)
+	}
+	if err != nil {
+		log.Printf("Config reload rejected, keeping running config: %v", err)
+		audit.AuditLog(fmt.Sprintf("Config reload (%s) rejected, keeping running config: %v", reason, err))
+		return
+	}
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	before := flattenSettings("", viper.AllSettings())
+	parsers.StopScheduler()
+
+	if err := swapConfig(content, candidate, settings); err != nil {
+		parsers.StartScheduler()
+		log.Printf("Config reload failed: %v", err)
+		audit.AuditLog(fmt.Sprintf("Config reload (%s) failed: %v", reason, err))
+		return
+	}
+	initURLHandlers()
+	activeHandler.Store(http.Handler(mainMux))
+	parsers.StartScheduler()
+
+	after := flattenSettings("", viper.AllSettings())
+	changes := describeChanges(before, after)
+	if keys := restartRequired(before, after); len(keys) > 0 {
+		changes += fmt.Sprintf("; requires restart, not applied: %s", strings.Join(keys, ", "))
+	}
+	log.Printf("Config reloaded (%s): %s", reason, changes)
+	audit.AuditLog(fmt.Sprintf("Config reloaded (%s): %s", reason, changes))
+}
+
+// Function to make a validated candidate the running config. The global config
+// is loaded from the content the candidate was validated from.
+func swapConfig(content *configContent, candidate *viper.Viper, settings oauth.Settings) error {
+	if err := applyConfig(candidate, settings); err != nil {
+		return err
+	}
+	return loadGlobalConfig(content)
+}
+
+// Function to list the changed settings that only take effect on a restart
+func restartRequired(before, after map[string]interface{}) []string {
+	keys := map[string]bool{}
+	for _, settings := range []map[string]interface{}{before, after} {
+		for key := range settings {
+			for _, prefix := range restartSettings {
+				if strings.HasPrefix(key+".", prefix) && !reflect.DeepEqual(before[key], after[key]) {
+					keys[key] = true
+				}
+			}
+		}
+	}
+
+	var changed []string
+	for key := range keys {
+		changed = append(changed, key)
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Function to watch the config file and its fragment directory and reload on
+// change. Editors and config management write in several steps, so changes
+// are collected for a moment before reloading.
+func watchConfig() error {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return fmt.Errorf("no config file in use")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// The directories are watched since files are often replaced by rename
+	dirs := []string{filepath.Dir(file)}
+	if _, err := os.Stat(fragmentDir(file)); err == nil {
+		dirs = append(dirs, fragmentDir(file))
+	}
+	for _, dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("watching %s: %v", dir, err)
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		var pending *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				inFragments := filepath.Dir(event.Name) == filepath.Clean(fragmentDir(file))
+				if filepath.Clean(event.Name) != filepath.Clean(file) && !inFragments {
+					continue
+				}
+				if pending != nil {
+					pending.Stop()
+				}
+				name := event.Name
+				pending = time.AfterFunc(200*time.Millisecond, func() {
+					reloadConfig(fmt.Sprintf("%s changed", name))
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Config watcher error: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Function to flatten nested settings into dotted keys
+func flattenSettings(prefix string, settings map[string]interface{}) map[string]interface{} {
+	flat := map[string]interface{}{}
+	for key, value := range settings {
+		if nested, ok := value.(map[string]interface{}); ok {
+			for k, v := range flattenSettings(prefix+key+".", nested) {
+				flat[k] = v
+			}
+			continue
+		}
+		flat[prefix+key] = value
+	}
+	return flat
+}
+
+// Function to list the keys that were added, removed or changed. Only key
+// names are reported since values include client secrets.
+func describeChanges(before, after map[string]interface{}) string {
+	var added, removed, changed []string
+	for key, value := range after {
+		old, ok := before[key]
+		if !ok {
+			added = append(added, key)
+		} else if !reflect.DeepEqual(old, value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	if len(added)+len(removed)+len(changed) == 0 {
+		return "no changes"
+	}
+
+	var parts []string
+	for _, group := range []struct {
+		name string
+		keys []string
+	}{{"added", added}, {"removed", removed}, {"changed", changed}} {
+		if len(group.keys) > 0 {
+			sort.Strings(group.keys)
+			parts = append(parts, fmt.Sprintf("%s %s", group.name, strings.Join(group.keys, ", ")))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
@@ -5,9 +5,9 @@ import (
 	"os"
 
 	"github.com/shadowbq/simple-node-health/audit"
-	"github.com/shadowbq/simple-node-health/oauth"
 	"github.com/shadowbq/simple-node-health/parsers"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -15,6 +15,9 @@ var (
 	port    int
 	domain  string
 	verbose bool
+
+	// configFlags are the flags bound to config keys
+	configFlags = map[string]*pflag.Flag{}
 )
 
 // Root command
@@ -25,7 +28,8 @@ var rootCmd = &cobra.Command{
 		initConfig()
 		audit.InitAuditLogger()
 		initURLHandlers()
-		runServer(port)
+		parsers.StartScheduler()
+		runServer(viper.GetInt("port"))
 	},
 }
 
@@ -33,10 +37,8 @@ var CreateClientCmd = &cobra.Command{
 	Use:   "create-client",
 	Short: "Create a new client_id and client_secret and append them to the config file",
 	Run: func(cmd *cobra.Command, args []string) {
-		createClient := oauth.CreateClientInternalCmd()
-		initConfig()
 		audit.InitAuditLogger()
-		createClient.Run(createClient, args)
+		createClient()
 	},
 }
 
@@ -49,11 +51,10 @@ func Execute() {
 
 func init() {
 
+	// Same as `client create`, kept for existing scripts
+	CreateClientCmd.Flags().StringSliceVar(&createScopes, "scope", nil, "Scope granted to the client, repeat or separate with commas (default every route)")
 	rootCmd.AddCommand(CreateClientCmd)
 
-	// The Create Client Comand needs to be init so CreateClientInternalCmd is wrapped by CreateClientCmd
-	// rootCmd.AddCommand(oauth.CreateClientInternalCmd())
-
 	// Add the command to show all registered routes
 	rootCmd.AddCommand(showRoutesCmd())
 
@@ -61,47 +62,53 @@ func init() {
 	var checkCmd = &cobra.Command{
 		Use:   "check",
 		Short: "Run various checks",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			initCheckConfig()
+		},
 	}
 
-	// Subcommand: checkstatus
-	var checkStatusCmd = &cobra.Command{
-		Use:   "status",
-		Short: "Check the service status",
-		Run:   parsers.CmdCheckStatus,
-	}
-
-	// Subcommand: checkdisks
-	var checkDisksCmd = &cobra.Command{
-		Use:   "disks",
-		Short: "Check EXT4 devices for read-only mode",
-		Run:   parsers.CmdCheckDisks,
+	// Subcommand for every registered check
+	for _, check := range parsers.Checks() {
+		checkCmd.AddCommand(&cobra.Command{
+			Use:   check.Name(),
+			Short: check.Description(),
+			Run:   parsers.CmdRunner(check),
+		})
 	}
 
-	// Subcommand: checkdns
-	var checkDNSCmd = &cobra.Command{
-		Use:   "dns",
-		Short: "Run a DNS query for the specified domain",
-		Run:   parsers.CmdCheckDNS,
+	// Subcommand: checkall
+	var checkAllCmd = &cobra.Command{
+		Use:   "all",
+		Short: "Run every enabled check and report the combined result",
+		Run:   parsers.CmdCheckAll,
 	}
-
-	// Add subcommands to the check command
-	checkCmd.AddCommand(checkStatusCmd, checkDisksCmd, checkDNSCmd)
+	checkCmd.AddCommand(checkAllCmd)
 
 	// Add the check command to the root command
 	rootCmd.AddCommand(checkCmd)
 
+	// Config file flags, not bound to Viper since they locate the config
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Config file (default $SNH_CONFIG or snh-config.yaml in ., /etc/snh, /usr/local/etc)")
+	rootCmd.PersistentFlags().StringVar(&configDir, "config-dir", "", "Directory of config fragments (default $SNH_CONFIG_DIR or snh-config.d next to the config file)")
+
 	rootCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "verbose output")
 	// bind the configuration to file/environment variables
-	cobra.CheckErr(viper.BindPFlag("verbose", rootCmd.PersistentFlags().Lookup("verbose")))
+	configFlags["verbose"] = rootCmd.PersistentFlags().Lookup("verbose")
+	cobra.CheckErr(viper.BindPFlag("verbose", configFlags["verbose"]))
 	viper.SetDefault("verbose", false)
 
 	// Domain flag
-	rootCmd.PersistentFlags().StringVarP(&domain, "domain", "d", "cloudflare.com", "Domain to query with dig")
-	viper.BindPFlag("domain", rootCmd.PersistentFlags().Lookup("domain"))
+	rootCmd.PersistentFlags().StringVarP(&domain, "domain", "d", "cloudflare.com", "Domain to query")
+	configFlags["domain"] = rootCmd.PersistentFlags().Lookup("domain")
+	viper.BindPFlag("domain", configFlags["domain"])
 
 	// Port flag
 	rootCmd.Flags().IntVarP(&port, "port", "p", 8080, "Port for the web server")
-	viper.BindPFlag("port", rootCmd.Flags().Lookup("port"))
+	configFlags["port"] = rootCmd.Flags().Lookup("port")
+	viper.BindPFlag("port", configFlags["port"])
+
+	// Defaults for everything that is not a flag
+	setDefaults(viper.GetViper())
 
 	// Bind environment variables
 	viper.AutomaticEnv()
@@ -0,0 +1,428 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shadowbq/simple-node-health/oauth"
+	"github.com/shadowbq/simple-node-health/parsers"
+	"gopkg.in/yaml.v3"
+)
+
+// Minimum lengths of the secrets in the config
+const (
+	minAuthTokenSecretLength = 32 // 256 bits for HS256
+	minClientSecretLength    = 16
+)
+
+// schemaKind is the type of value expected at a config key
+type schemaKind int
+
+const (
+	kindString schemaKind = iota
+	kindBool
+	kindInt
+	kindNumber
+	kindDuration
+	kindMap
+	kindList
+)
+
+// schemaNode describes the expected shape of a config value
+type schemaNode struct {
+	kind   schemaKind
+	fields map[string]*schemaNode  // Keys of a map, matched case-insensitively like Viper
+	items  *schemaNode             // Element of a list
+	unique string                  // Field that must be unique across the elements of a list
+	check  func(*yaml.Node) string // Extra validation of a scalar, returns the problem
+}
+
+type fields map[string]*schemaNode
+
+// configIssue is a problem found in the config file
+type configIssue struct {
+	File    string
+	Line    int
+	Column  int
+	Key     string
+	Message string
+	Warning bool
+}
+
+func (issue configIssue) String() string {
+	level := "error"
+	if issue.Warning {
+		level = "warning"
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s: %s", issue.File, issue.Line, issue.Column, level, issue.Key, issue.Message)
+}
+
+func str() *schemaNode                 { return &schemaNode{kind: kindString} }
+func boolean() *schemaNode             { return &schemaNode{kind: kindBool} }
+func integer() *schemaNode             { return &schemaNode{kind: kindInt} }
+func number() *schemaNode              { return &schemaNode{kind: kindNumber} }
+func duration() *schemaNode            { return &schemaNode{kind: kindDuration} }
+func mapOf(f fields) *schemaNode       { return &schemaNode{kind: kindMap, fields: f} }
+func listOf(i *schemaNode) *schemaNode { return &schemaNode{kind: kindList, items: i} }
+
+// Function to add an extra check to a schema node
+func (s *schemaNode) with(check func(*yaml.Node) string) *schemaNode {
+	s.check = check
+	return s
+}
+
+// Function to require a field to be unique across the elements of a list
+func (s *schemaNode) uniqueBy(field string) *schemaNode {
+	s.unique = field
+	return s
+}
+
+// Function to check a value is one of a fixed set, ignoring case
+func oneOf(values ...string) func(*yaml.Node) string {
+	return func(n *yaml.Node) string {
+		for _, value := range values {
+			if strings.EqualFold(n.Value, value) {
+				return ""
+			}
+		}
+		return fmt.Sprintf("must be one of %s, got %q", strings.Join(values, ", "), n.Value)
+	}
+}
+
+// Function to check a value is one of a fixed set, case sensitive
+func exactly(values ...string) func(*yaml.Node) string {
+	return func(n *yaml.Node) string {
+		for _, value := range values {
+			if n.Value == value {
+				return ""
+			}
+		}
+		return fmt.Sprintf("must be one of %s, got %q", strings.Join(values, ", "), n.Value)
+	}
+}
+
+// Function to check a string has a minimum length
+func minLength(length int) func(*yaml.Node) string {
+	return func(n *yaml.Node) string {
+		if len(n.Value) < length {
+			return fmt.Sprintf("must be at least %d characters, got %d", length, len(n.Value))
+		}
+		return ""
+	}
+}
+
+// Function to check an integer is within a range
+func between(min, max int) func(*yaml.Node) string {
+	return func(n *yaml.Node) string {
+		var value int
+		if err := n.Decode(&value); err != nil || value < min || value > max {
+			return fmt.Sprintf("must be between %d and %d, got %s", min, max, n.Value)
+		}
+		return ""
+	}
+}
+
+// Function to check a value is a bcrypt hash
+func bcryptHash(n *yaml.Node) string {
+	if !oauth.ValidSecretHash(n.Value) {
+		return "must be a bcrypt hash as written by create-client"
+	}
+	return ""
+}
+
+// Function to check a value is an RFC 3339 timestamp
+func timestamp(n *yaml.Node) string {
+	if _, err := time.Parse(time.RFC3339, n.Value); err != nil {
+		return fmt.Sprintf("must be an RFC 3339 timestamp such as 2024-09-04T16:32:26Z, got %q", n.Value)
+	}
+	return ""
+}
+
+// Function to check a value is an issuer identifier, an http(s) URL without query or fragment
+func issuerURL(n *yaml.Node) string {
+	u, err := url.Parse(n.Value)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Sprintf("must be an https URL without query or fragment such as https://health.example.com, got %q", n.Value)
+	}
+	return ""
+}
+
+// Function to list every scope a route can require
+func knownScopes() []string {
+	scopes := []string{oauth.ScopeCheckAll, oauth.ScopeCheckPrefix + "*", oauth.ScopeMetricsRead, oauth.ScopeIntrospect}
+	for _, check := range parsers.Checks() {
+		scopes = append(scopes, oauth.ScopeCheckPrefix+check.Name())
+	}
+	return scopes
+}
+
+// Function to check a value is a scope a route can require, scopes are case sensitive
+func validScope(n *yaml.Node) string {
+	return exactly(knownScopes()...)(n)
+}
+
+// Function to describe every key the config file may contain
+func configSchema() *schemaNode {
+	threshold := mapOf(fields{"warning": number(), "critical": number()})
+	recordType := str().with(oneOf("A", "AAAA", "MX", "TXT", "SRV", "CNAME"))
+
+	checks := fields{"timeout": duration(), "fresh_min_interval": duration()}
+	for _, check := range parsers.Checks() {
+		checks[check.Name()] = mapOf(fields{"enabled": boolean(), "timeout": duration(), "interval": duration()})
+	}
+
+	httpStatus := fields{}
+	for state := range parsers.DefaultHTTPStatus {
+		httpStatus[string(state)] = integer().with(between(100, 599))
+	}
+
+	return mapOf(fields{
+		"authtokensecret": str().with(minLength(minAuthTokenSecretLength)),
+		"insecure":        boolean(),
+		"clients": listOf(mapOf(fields{
+			"client_id":               str(),
+			"client_secret":           str().with(minLength(minClientSecretLength)),
+			"client_secret_hash":      str().with(bcryptHash),
+			"previous_secret_hash":    str().with(bcryptHash),
+			"previous_secret_expires": str().with(timestamp),
+			"created_at":              str().with(timestamp),
+			"scopes":                  listOf(str().with(validScope)),
+			"token_lifetime":          duration(),
+		})).uniqueBy("client_id"),
+		"domain":       str(),
+		"port":         integer().with(between(1, 65535)),
+		"verbose":      boolean(),
+		"watch_config": boolean(),
+		"state_dir":    str(),
+		"issuer":       str().with(issuerURL),
+		"tokens": mapOf(fields{
+			"lifetime": duration(),
+			"leeway":   duration(),
+			"audience": str(),
+		}),
+		"rate_limit": mapOf(fields{
+			"requests_per_minute": integer().with(between(0, 1000000)),
+			"max_failures":        integer().with(between(0, 1000000)),
+			"lockout":             duration(),
+			"max_lockout":         duration(),
+			"trusted_proxies":     listOf(str()),
+		}),
+		"signing": mapOf(fields{
+			"key_dir": str(),
+			"keys": listOf(mapOf(fields{
+				"kid":       str(),
+				"algorithm": str().with(exactly(oauth.Algorithms...)),
+				"file":      str(),
+				"secret":    str().with(minLength(minAuthTokenSecretLength)),
+				"active":    boolean(),
+			})).uniqueBy("kid"),
+		}),
+		"disks": mapOf(fields{
+			"mountinfo": str(),
+			"fstypes":   listOf(str()),
+			"include":   listOf(str()),
+			"exclude":   listOf(str()),
+			"rules": listOf(mapOf(fields{
+				"name":       str(),
+				"mountpoint": str(),
+				"when":       str(),
+				"option":     str(),
+				"missing":    str(),
+			})).uniqueBy("name"),
+			"thresholds": mapOf(fields{"space": threshold, "inodes": threshold}),
+			"overrides":  listOf(mapOf(fields{"mountpoint": str(), "space": threshold, "inodes": threshold})),
+		}),
+		"dns": mapOf(fields{
+			"type":        recordType,
+			"timeout":     duration(),
+			"resolv_conf": str(),
+			"servers":     listOf(str()),
+			"allow":       listOf(str()),
+			"probes": listOf(mapOf(fields{
+				"name":    str(),
+				"query":   str(),
+				"type":    recordType,
+				"server":  str(),
+				"timeout": duration(),
+				"expect": mapOf(fields{
+					"contains":    listOf(str()),
+					"match":       str(),
+					"min_answers": integer(),
+					"max_latency": duration(),
+				}),
+			})).uniqueBy("name"),
+		}),
+		"checks":  mapOf(checks),
+		"metrics": mapOf(fields{"enabled": boolean(), "public": boolean()}),
+		"tls": mapOf(fields{
+			"cert":        str(),
+			"key":         str(),
+			"min_version": str().with(oneOf("1.0", "1.1", "1.2", "1.3")),
+			"client_ca":   str(),
+			"client_auth": str().with(oneOf("require", "optional")),
+		}),
+		"server": mapOf(fields{
+			"read_timeout":        duration(),
+			"read_header_timeout": duration(),
+			"write_timeout":       duration(),
+			"idle_timeout":        duration(),
+			"shutdown_timeout":    duration(),
+		}),
+		"http_status": mapOf(httpStatus),
+	})
+}
+
+// Function to check a config file against the schema. Unknown keys are
+// warnings, everything else that would be ignored or fail at runtime is an error.
+func checkConfigData(file string, data []byte) ([]configIssue, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", file, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	var issues []configIssue
+	report := func(n *yaml.Node, key string, warning bool, format string, args ...interface{}) {
+		issues = append(issues, configIssue{File: file, Line: n.Line, Column: n.Column, Key: key, Message: fmt.Sprintf(format, args...), Warning: warning})
+	}
+	walkSchema(configSchema(), doc.Content[0], "", report)
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].Line != issues[j].Line {
+			return issues[i].Line < issues[j].Line
+		}
+		return issues[i].Column < issues[j].Column
+	})
+	return issues, nil
+}
+
+// Function to check the main config file and its fragments against the schema
+func checkConfigFiles(file string) ([]configIssue, error) {
+	content, err := readConfigContent(file)
+	if err != nil {
+		return nil, err
+	}
+	return content.check()
+}
+
+// Function to check the content of the main config file and its fragments against the schema
+func (c *configContent) check() ([]configIssue, error) {
+	issues, err := checkConfigData(c.file, c.data)
+	if err != nil {
+		return nil, err
+	}
+	for _, fragment := range c.fragments {
+		fragmentIssues, err := checkConfigData(fragment.file, fragment.data)
+		if err != nil {
+			return nil, err
+		}
+		issues = append(issues, fragmentIssues...)
+	}
+	return issues, nil
+}
+
+// Function to check a YAML node and its children against a schema node
+func walkSchema(s *schemaNode, n *yaml.Node, key string, report func(*yaml.Node, string, bool, string, ...interface{})) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Tag == "!!null" {
+		return
+	}
+
+	switch s.kind {
+	case kindMap:
+		if n.Kind != yaml.MappingNode {
+			report(n, key, false, "must be a mapping")
+			return
+		}
+		seen := map[string]*yaml.Node{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			name := strings.ToLower(k.Value)
+			path := name
+			if key != "" {
+				path = key + "." + name
+			}
+			if first, ok := seen[name]; ok {
+				report(k, path, false, "defined again, first defined on line %d", first.Line)
+				continue
+			}
+			seen[name] = k
+			child, ok := s.fields[name]
+			if !ok {
+				report(k, path, true, "unknown key, it is ignored")
+				continue
+			}
+			walkSchema(child, v, path, report)
+		}
+
+	case kindList:
+		if n.Kind != yaml.SequenceNode {
+			report(n, key, false, "must be a list")
+			return
+		}
+		seen := map[string]*yaml.Node{}
+		for i, item := range n.Content {
+			path := fmt.Sprintf("%s[%d]", key, i)
+			walkSchema(s.items, item, path, report)
+			if s.unique == "" || item.Kind != yaml.MappingNode {
+				continue
+			}
+			for j := 0; j+1 < len(item.Content); j += 2 {
+				if !strings.EqualFold(item.Content[j].Value, s.unique) {
+					continue
+				}
+				v := item.Content[j+1]
+				if first, ok := seen[v.Value]; ok {
+					report(v, path+"."+s.unique, false, "duplicate %q, first defined on line %d", v.Value, first.Line)
+				} else {
+					seen[v.Value] = v
+				}
+			}
+		}
+
+	default:
+		if n.Kind != yaml.ScalarNode {
+			report(n, key, false, "must be a single value")
+			return
+		}
+		if problem := checkScalar(s.kind, n); problem != "" {
+			report(n, key, false, "%s", problem)
+			return
+		}
+		if s.check != nil {
+			if problem := s.check(n); problem != "" {
+				report(n, key, false, "%s", problem)
+			}
+		}
+	}
+}
+
+// Function to check the type of a scalar, returns the problem
+func checkScalar(kind schemaKind, n *yaml.Node) string {
+	switch kind {
+	case kindBool:
+		if n.Tag != "!!bool" {
+			return fmt.Sprintf("must be true or false, got %q", n.Value)
+		}
+	case kindInt:
+		if n.Tag != "!!int" {
+			return fmt.Sprintf("must be a whole number, got %q", n.Value)
+		}
+	case kindNumber:
+		if n.Tag != "!!int" && n.Tag != "!!float" {
+			return fmt.Sprintf("must be a number, got %q", n.Value)
+		}
+	case kindDuration:
+		if _, err := time.ParseDuration(n.Value); err != nil || n.Tag != "!!str" {
+			return fmt.Sprintf("must be a duration with a unit such as 10s or 500ms, got %q", n.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/shadowbq/simple-node-health/audit"
+	"github.com/shadowbq/simple-node-health/oauth"
+	"github.com/shadowbq/simple-node-health/parsers"
+	"github.com/spf13/viper"
+)
+
+// Function to run the server until SIGTERM or SIGINT, draining in-flight
+// requests for up to `server.shutdown_timeout`. SIGHUP reloads the config.
+func runServer(port int) {
+	activeHandler.Store(http.Handler(mainMux))
+	if viper.GetBool("watch_config") {
+		if err := watchConfig(); err != nil {
+			log.Printf("Config file will not be reloaded on change: %v", err)
+		}
+	}
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           reloadableHandler{},
+		ReadTimeout:       viper.GetDuration("server.read_timeout"),
+		ReadHeaderTimeout: viper.GetDuration("server.read_header_timeout"),
+		WriteTimeout:      viper.GetDuration("server.write_timeout"),
+		IdleTimeout:       viper.GetDuration("server.idle_timeout"),
+	}
+
+	settings, tlsEnabled := loadTLSSettings(viper.GetViper())
+	scheme := "http"
+	if tlsEnabled {
+		reloader, err := newCertReloader(settings)
+		if err != nil {
+			log.Fatalf("TLS configuration error: %v", err)
+		}
+		if err := reloader.watch(); err != nil {
+			log.Printf("TLS certificates will not be reloaded on change: %v", err)
+		}
+		server.TLSConfig = reloader.TLSConfig()
+		scheme = "https"
+	}
+
+	audit.AuditLog(fmt.Sprintf("Starting server on port %d (%s)...", port, scheme))
+	log.Printf("Starting server on port %d (%s)...\n", port, scheme)
+	log.Printf("Liveness check available at %s://localhost:%d/ready\n", scheme, port)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if tlsEnabled {
+			// The certificates come from the TLS config so they can be reloaded
+			serverErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case err := <-serverErr:
+			audit.AuditLog(fmt.Sprintf("Server stopped: %v", err))
+			log.Fatalf("Server failed to start: %v", err)
+
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reloadConfig("SIGHUP")
+				continue
+			}
+
+			shutdownServer(server, fmt.Sprintf("received %s", sig))
+			return
+		}
+	}
+}
+
+// Function to stop accepting connections and wait for in-flight requests to finish
+func shutdownServer(server *http.Server, reason string) {
+	timeout := viper.GetDuration("server.shutdown_timeout")
+	log.Printf("Shutting down server (%s), draining for up to %s", reason, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	parsers.StopScheduler()
+	err := server.Shutdown(ctx)
+	oauth.FlushClientUse()
+	if errors.Is(err, context.DeadlineExceeded) {
+		server.Close()
+		audit.AuditLog(fmt.Sprintf("Server stopped (%s): drain deadline of %s exceeded, remaining connections closed", reason, timeout))
+		log.Printf("Server stopped, drain deadline exceeded")
+		return
+	}
+
+	audit.AuditLog(fmt.Sprintf("Server stopped (%s)", reason))
+	log.Printf("Server stopped")
+}
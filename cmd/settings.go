@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"fmt"
+	"slices"
+	"sort"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -26,34 +28,30 @@ var versionCmd = &cobra.Command{
 var settingsCmd = &cobra.Command{
 	Use:   "settings",
 	Short: "Print the current configuration settings",
-	Long: `Print the current configuration settings. This command is useful to see the final configuration once all the settings have been applied. 
-		It also shows how to access the global flags and command flags.`,
+	Long: `Print the current configuration settings. This command is useful to see the final configuration once all the settings have been applied,
+		with the flag, environment variable, file or default each value came from. Secrets are masked.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		//fmt.Println("Settings called")
+		initCheckConfig()
 
 		if verbose {
 			fmt.Println("--- Final configuration  ---")
+			if file := viper.ConfigFileUsed(); file != "" {
+				fmt.Printf("\tConfig file: %s\n", file)
+				fmt.Printf("\tFragments: %s\n", fragmentDir(file))
+			}
 		}
-		//fmt.Printf("\tVersion: %s\n", Version)
-		//for s, i := range viper.AllSettings() {
-		//	fmt.Printf("\t%s: %v\n", s, i)
-		//}
 
-		keys := viper.AllSettings()
-		//sort keys
+		settings := flattenSettings("", viper.AllSettings())
+
+		// get the keys and print them in sorted order
 		var keysSorted []string
-		for key := range keys {
+		for key := range settings {
 			keysSorted = append(keysSorted, key)
 		}
+		sort.Strings(keysSorted)
 
-		// get the keys and print them in sorted order
 		for _, key := range keysSorted {
-			if key == "clientsecret" {
-				// Print the clientSecret first 4 characters then the rest as *
-				fmt.Printf("\t%s: %v\n", key, viper.Get(key).(string)[:4]+"********")
-			} else {
-				fmt.Printf("\t%s: %v\n", key, viper.Get(key))
-			}
+			fmt.Printf("\t%s: %v  (%s)\n", key, maskSetting(key, settings[key]), configSource(key))
 		}
 
 		if verbose {
@@ -63,6 +61,47 @@ var settingsCmd = &cobra.Command{
 	},
 }
 
+// Function to mask the secrets in a setting
+func maskSetting(key string, value interface{}) interface{} {
+	mask := func(secret interface{}) string {
+		if s := fmt.Sprint(secret); len(s) > 4 {
+			// Print the first 4 characters then the rest as *
+			return s[:4] + "********"
+		}
+		return "********"
+	}
+
+	// Secrets inside the entries of lists
+	listSecrets := map[string][]string{
+		"clients":      {"client_secret", "client_secret_hash", "previous_secret_hash"},
+		"signing.keys": {"secret"},
+	}
+
+	if key == "authtokensecret" {
+		return mask(value)
+	}
+	fields, ok := listSecrets[key]
+	entries, isList := value.([]interface{})
+	if !ok || !isList {
+		return value
+	}
+	var masked []interface{}
+	for _, entry := range entries {
+		if e, ok := entry.(map[string]interface{}); ok {
+			copied := map[string]interface{}{}
+			for k, v := range e {
+				if slices.Contains(fields, k) {
+					v = mask(v)
+				}
+				copied[k] = v
+			}
+			entry = copied
+		}
+		masked = append(masked, entry)
+	}
+	return masked
+}
+
 func init() {
 	rootCmd.AddCommand(settingsCmd)
 	rootCmd.AddCommand(versionCmd)
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/shadowbq/simple-node-health/audit"
+	"github.com/spf13/viper"
+)
+
+// TLSSettings is the `tls` section of the config
+type TLSSettings struct {
+	Cert       string `mapstructure:"cert"`
+	Key        string `mapstructure:"key"`
+	MinVersion string `mapstructure:"min_version"`
+	ClientCA   string `mapstructure:"client_ca"`
+	ClientAuth string `mapstructure:"client_auth"` // require or optional, only used with client_ca
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader serves the current certificate and client CA pool, reloading them when the files change
+type certReloader struct {
+	settings TLSSettings
+
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+// Function to load the TLS settings from a config, TLS is enabled when a certificate is set
+func loadTLSSettings(v *viper.Viper) (TLSSettings, bool) {
+	settings := TLSSettings{
+		Cert:       v.GetString("tls.cert"),
+		Key:        v.GetString("tls.key"),
+		MinVersion: v.GetString("tls.min_version"),
+		ClientCA:   v.GetString("tls.client_ca"),
+		ClientAuth: v.GetString("tls.client_auth"),
+	}
+	return settings, settings.Cert != ""
+}
+
+// Function to create a reloader and load the initial certificates
+func newCertReloader(settings TLSSettings) (*certReloader, error) {
+	cr := &certReloader{settings: settings}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Function to build the TLS config from the files on disk
+func (cr *certReloader) build() (*tls.Config, error) {
+	s := cr.settings
+
+	minVersion, ok := tlsVersions[s.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls.min_version %q (use 1.0, 1.1, 1.2 or 1.3)", s.MinVersion)
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.Cert, s.Key)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %v", err)
+	}
+
+	// The config is served per handshake by GetConfigForClient, which bypasses the
+	// protocols net/http adds to the server config, so HTTP/2 is offered here
+	config := &tls.Config{
+		MinVersion:   minVersion,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if s.ClientCA != "" {
+		pem, err := os.ReadFile(s.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA %s", s.ClientCA)
+		}
+		config.ClientCAs = pool
+
+		switch s.ClientAuth {
+		case "require":
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("invalid tls.client_auth %q (use require or optional)", s.ClientAuth)
+		}
+	}
+
+	return config, nil
+}
+
+// Function to reload the certificates, the previous config stays in use when the new files are invalid
+func (cr *certReloader) reload() error {
+	config, err := cr.build()
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	cr.config = config
+	cr.mu.Unlock()
+	return nil
+}
+
+// TLSConfig returns a server config that picks up reloaded certificates on every handshake
+func (cr *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cr.mu.RLock()
+			defer cr.mu.RUnlock()
+			return cr.config, nil
+		},
+	}
+}
+
+// Function to watch the certificate files and reload them on change. The
+// directories are watched since certificates are usually replaced by rename.
+func (cr *certReloader) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	files := map[string]bool{}
+	for _, file := range []string{cr.settings.Cert, cr.settings.Key, cr.settings.ClientCA} {
+		if file == "" {
+			continue
+		}
+		files[filepath.Clean(file)] = true
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			watcher.Close()
+			return fmt.Errorf("watching %s: %v", filepath.Dir(file), err)
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !files[filepath.Clean(event.Name)] || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if err := cr.reload(); err != nil {
+					log.Printf("Keeping previous TLS certificates, reload failed: %v", err)
+					audit.AuditLog(fmt.Sprintf("TLS certificate reload failed: %v", err))
+					continue
+				}
+				log.Printf("Reloaded TLS certificates after change to %s", event.Name)
+				audit.AuditLog(fmt.Sprintf("TLS certificates reloaded after change to %s", event.Name))
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("TLS certificate watcher error: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
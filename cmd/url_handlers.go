@@ -5,11 +5,11 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"sort"
 
 	"github.com/shadowbq/simple-node-health/audit"
 	"github.com/shadowbq/simple-node-health/helpers"
+	"github.com/shadowbq/simple-node-health/metrics"
 	"github.com/shadowbq/simple-node-health/oauth"
 	"github.com/shadowbq/simple-node-health/parsers"
 	"github.com/spf13/cobra"
@@ -95,6 +95,20 @@ func showRoutesCmd() *cobra.Command {
 	}
 }
 
+// Function to register the `/check/<name>` route of every registered check
+func handleChecks(rtm *RouteTrackingMux) {
+	for _, check := range parsers.Checks() {
+		rtm.Handle("/check/"+check.Name(), oauth.RequireScope(oauth.ScopeCheckPrefix+check.Name(), parsers.HTTPHandler(check)))
+	}
+}
+
+func init() {
+	// The aggregate only shows the details of the checks the token has a scope for
+	parsers.ShowDetails = func(r *http.Request, check string) bool {
+		return oauth.HasScope(r, oauth.ScopeCheckPrefix+check)
+	}
+}
+
 // Start the web server with configurable port
 func initURLHandlers() {
 
@@ -102,29 +116,44 @@ func initURLHandlers() {
 	unprotectedMux := NewRouteTrackingMux()
 	unprotectedMux.HandleFunc("/token", oauth.TokenHandler)
 	unprotectedMux.HandleFunc("/ready", parsers.HTTPCheckStatus)
+	unprotectedMux.HandleFunc(oauth.RevokePath, oauth.RevokeHandler)
+	unprotectedMux.HandleFunc(oauth.IntrospectPath, oauth.IntrospectHandler)
+	unprotectedMux.HandleFunc(oauth.JWKSPath, oauth.JWKSHandler)
+	unprotectedMux.HandleFunc(oauth.MetadataPath, oauth.MetadataHandler)
+
+	// Metrics are protected like the checks unless configured as public
+	metricsPublic := viper.GetBool("metrics.enabled") && viper.GetBool("metrics.public")
+	if metricsPublic {
+		unprotectedMux.Handle("/metrics", metrics.Handler())
+	}
 
 	// Check if insecure mode is enabled in the config
 	if viper.GetBool("insecure") {
 		log.Println("NOTICE: Insecure mode enabled. Loading protected routes on insecure route handler.")
 
 		// Unprotected routes due to insecure mode
-		unprotectedMux.HandleFunc("/", parsers.HTTPCheckStatus)
-		unprotectedMux.HandleFunc("/check", parsers.HTTPCheckStatus)
-		unprotectedMux.HandleFunc("/check/disks", parsers.HTTPCheckDisks)
-		unprotectedMux.HandleFunc("/check/dns", parsers.HTTPCheckDNS)
+		unprotectedMux.HandleFunc("/", parsers.HTTPCheckAll)
+		unprotectedMux.HandleFunc("/check", parsers.HTTPCheckAll)
+		handleChecks(unprotectedMux)
+		if viper.GetBool("metrics.enabled") && !metricsPublic {
+			unprotectedMux.Handle("/metrics", metrics.Handler())
+		}
 
 		mainMux = unprotectedMux
 
-		routes = append(unprotectedMux.Routes())
+		routes = unprotectedMux.Routes()
 
 	} else {
 
-		// Protected routes
+		// Protected routes, each requires a scope of the token
+		checkAll := oauth.RequireScope(oauth.ScopeCheckAll, http.HandlerFunc(parsers.HTTPCheckAll))
 		mux := NewRouteTrackingMux()
-		mux.HandleFunc("/", parsers.HTTPCheckStatus)
-		mux.HandleFunc("/check", parsers.HTTPCheckStatus)
-		mux.HandleFunc("/check/disks", parsers.HTTPCheckDisks)
-		mux.HandleFunc("/check/dns", parsers.HTTPCheckDNS)
+		mux.Handle("/", checkAll)
+		mux.Handle("/check", checkAll)
+		handleChecks(mux)
+		if viper.GetBool("metrics.enabled") && !metricsPublic {
+			mux.Handle("/metrics", oauth.RequireScope(oauth.ScopeMetricsRead, metrics.Handler()))
+		}
 
 		secureMux := oauth.TokenAuthMiddleware(mux)
 
@@ -132,6 +161,13 @@ func initURLHandlers() {
 		mainMux = NewRouteTrackingMux()
 		mainMux.Handle("/token", unprotectedMux)
 		mainMux.Handle("/ready", unprotectedMux)
+		mainMux.Handle(oauth.RevokePath, unprotectedMux)
+		mainMux.Handle(oauth.IntrospectPath, unprotectedMux)
+		mainMux.Handle(oauth.JWKSPath, unprotectedMux)
+		mainMux.Handle(oauth.MetadataPath, unprotectedMux)
+		if metricsPublic {
+			mainMux.Handle("/metrics", unprotectedMux)
+		}
 		mainMux.Handle("/", secureMux) // All other routes go through the secure mux
 
 		routes = append(mainMux.Routes(), unprotectedMux.Routes()...)
@@ -144,13 +180,3 @@ func initURLHandlers() {
 	}
 
 }
-
-func runServer(port int) {
-	audit.AuditLog(fmt.Sprintf("Starting server on port %d...\n", port))
-	log.Printf("Starting server on port %d...\n", port)
-	log.Printf("Liveness check available at http://localhost:%d/ready\n", port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), mainMux); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
-		os.Exit(1)
-	}
-}
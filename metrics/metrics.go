@@ -0,0 +1,92 @@
+// Package metrics - metrics.go - Prometheus metrics for the check results and the token endpoints.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds every snh metric plus the Go runtime and process collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	// CheckState is the last state of each check: 0 pass, 1 warn, 2 fail
+	CheckState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "snh_check_state",
+		Help: "Last state of the check (0 pass, 1 warn, 2 fail).",
+	}, []string{"check"})
+
+	// CheckDuration is how long each check run took
+	CheckDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "snh_check_duration_seconds",
+		Help:    "Duration of check runs.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"check"})
+
+	// DNSLatency is the response time of each DNS probe
+	DNSLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "snh_dns_latency_seconds",
+		Help:    "Response time of DNS probes.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"probe"})
+
+	// DiskUsedRatio is the used fraction of space and inodes of each checked mount
+	DiskUsedRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "snh_disk_used_ratio",
+		Help: "Used fraction of the space or inodes of a checked mount.",
+	}, []string{"mountpoint", "resource"})
+
+	// DiskReadOnlyMounts is the number of checked mounts that are read-only
+	DiskReadOnlyMounts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "snh_disk_readonly_mounts",
+		Help: "Number of checked mounts that are read-only.",
+	})
+
+	// TokensIssued counts the tokens issued by /token per client
+	TokensIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "snh_tokens_issued_total",
+		Help: "Tokens issued by the token endpoint.",
+	}, []string{"client_id"})
+
+	// AuthFailures counts the requests rejected by the token middleware per reason
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "snh_auth_failures_total",
+		Help: "Requests to protected routes rejected by the token middleware.",
+	}, []string{"reason"})
+
+	// TokenRequestsLimited counts the requests to the client authenticated endpoints refused by the rate limits
+	TokenRequestsLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "snh_token_requests_limited_total",
+		Help: "Requests to /token, /revoke and /introspect refused by the rate limits and lockouts.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		CheckState,
+		CheckDuration,
+		DNSLatency,
+		DiskUsedRatio,
+		DiskReadOnlyMounts,
+		TokensIssued,
+		AuthFailures,
+		TokenRequestsLimited,
+	)
+}
+
+// ObserveCheck records the state severity and duration of a check run
+func ObserveCheck(check string, severity int, duration time.Duration) {
+	CheckState.WithLabelValues(check).Set(float64(severity))
+	CheckDuration.WithLabelValues(check).Observe(duration.Seconds())
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,77 @@
+// Package oauth - introspect.go - Token introspection for resource servers.
+package oauth
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Introspection is the response of the introspection endpoint (RFC 7662 section 2.2)
+type Introspection struct {
+	Active    bool             `json:"active"`
+	Scope     string           `json:"scope,omitempty"`
+	ClientID  string           `json:"client_id,omitempty"`
+	TokenType string           `json:"token_type,omitempty"`
+	ExpiresAt *jwt.NumericDate `json:"exp,omitempty"`
+	IssuedAt  *jwt.NumericDate `json:"iat,omitempty"`
+	NotBefore *jwt.NumericDate `json:"nbf,omitempty"`
+	Subject   string           `json:"sub,omitempty"`
+	Audience  jwt.ClaimStrings `json:"aud,omitempty"`
+	Issuer    string           `json:"iss,omitempty"`
+	ID        string           `json:"jti,omitempty"`
+}
+
+// Function to check the state of a token (RFC 7662). A client can introspect its
+// own tokens, those of other clients need the token:introspect scope, which a
+// client without scopes does not have.
+func IntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	tokenString := r.PostFormValue("token")
+	if tokenString == "" {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	claims := &Claims{}
+	if err := verifyClaims(tokenString, claims); err != nil {
+		writeTokenResponse(w, http.StatusOK, Introspection{Active: false})
+		return
+	}
+	if claims.ClientID != client.ClientID && !scopeGranted(client.Scopes, ScopeIntrospect) {
+		writeTokenResponse(w, http.StatusOK, Introspection{Active: false})
+		return
+	}
+
+	writeTokenResponse(w, http.StatusOK, Introspection{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		TokenType: "Bearer",
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		NotBefore: claims.NotBefore,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		ID:        claims.ID,
+	})
+}
+
+// Function to check a token is usable the way the middleware checks it
+func verifyClaims(tokenString string, claims *Claims) error {
+	if _, err := parseToken(tokenString, claims); err != nil {
+		return err
+	}
+	if _, ok := lookupClient(claims.ClientID); !ok || claims.Subject != claims.ClientID {
+		return errors.New("token of an unknown client")
+	}
+	if revoked, err := isRevoked(claims); err != nil || revoked {
+		return errors.New("token revoked or revocations unreadable")
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+// Package oauth - keys.go - The keys tokens are signed and verified with.
+package oauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// Algorithms are the supported signing algorithms
+var Algorithms = []string{AlgHS256, AlgRS256, AlgES256, AlgEdDSA}
+
+// minHMACKeyLength is the shortest accepted HS256 secret, 256 bits
+const minHMACKeyLength = 32
+
+// KeyConfig is an entry of `signing.keys` in the config
+type KeyConfig struct {
+	ID        string `mapstructure:"kid"`
+	Algorithm string `mapstructure:"algorithm"`
+	File      string `mapstructure:"file"`   // PEM private key, or the secret for HS256
+	Secret    string `mapstructure:"secret"` // Inline HS256 secret
+	Active    bool   `mapstructure:"active"` // Signs new tokens, the other keys only verify
+}
+
+// SigningKey is a loaded key
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	method    jwt.SigningMethod
+	private   interface{} // []byte for HS256, otherwise a private key
+	public    interface{} // []byte for HS256, otherwise the public key
+}
+
+// KeySet is the active signing key and every key tokens are verified with
+type KeySet struct {
+	Active *SigningKey
+	Keys   map[string]*SigningKey // by kid
+}
+
+// PublicKey returns the public key of an asymmetric key, nil for HS256
+func (key *SigningKey) PublicKey() crypto.PublicKey {
+	if key.Algorithm == AlgHS256 {
+		return nil
+	}
+	return key.public
+}
+
+// LoadKeySet loads the configured keys. A legacy authTokenSecret becomes an
+// HS256 key, active only when no other key is. Exactly one key must be active.
+func LoadKeySet(configs []KeyConfig, authTokenSecret string) (*KeySet, error) {
+	set := &KeySet{Keys: map[string]*SigningKey{}}
+
+	for _, cfg := range configs {
+		key, err := loadKey(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q: %v", cfg.ID, err)
+		}
+		if _, ok := set.Keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate signing key kid %q", key.ID)
+		}
+		set.Keys[key.ID] = key
+
+		if cfg.Active || len(configs) == 1 {
+			if set.Active != nil {
+				return nil, fmt.Errorf("signing keys %q and %q are both active", set.Active.ID, key.ID)
+			}
+			set.Active = key
+		}
+	}
+	if len(configs) > 0 && set.Active == nil {
+		return nil, fmt.Errorf("no signing key is marked active")
+	}
+
+	if authTokenSecret != "" {
+		key, err := hmacKey(legacyKeyID(authTokenSecret), []byte(authTokenSecret))
+		if err != nil {
+			return nil, fmt.Errorf("authTokenSecret: %v", err)
+		}
+		if _, ok := set.Keys[key.ID]; !ok {
+			set.Keys[key.ID] = key
+		}
+		if set.Active == nil {
+			set.Active = key
+		}
+	}
+
+	if set.Active == nil {
+		return nil, fmt.Errorf("no signing key, configure signing.keys or authTokenSecret")
+	}
+	return set, nil
+}
+
+// Function to derive a stable kid for the legacy authTokenSecret without revealing it
+func legacyKeyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "hs-" + hex.EncodeToString(sum[:4])
+}
+
+// Function to load a configured key
+func loadKey(cfg KeyConfig) (*SigningKey, error) {
+	if cfg.ID == "" {
+		return nil, fmt.Errorf("kid is required")
+	}
+	if (cfg.File == "") == (cfg.Secret == "") {
+		return nil, fmt.Errorf("set either file or secret")
+	}
+
+	material := []byte(cfg.Secret)
+	if cfg.File != "" {
+		var err error
+		if material, err = os.ReadFile(cfg.File); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Algorithm == AlgHS256 {
+		return hmacKey(cfg.ID, []byte(strings.TrimSpace(string(material))))
+	}
+	if cfg.Secret != "" {
+		return nil, fmt.Errorf("an inline secret is only supported for %s", AlgHS256)
+	}
+	return privateKey(cfg.ID, cfg.Algorithm, material)
+}
+
+// Function to build an HS256 key
+func hmacKey(id string, secret []byte) (*SigningKey, error) {
+	if len(secret) < minHMACKeyLength {
+		return nil, fmt.Errorf("%s secret must be at least %d characters", AlgHS256, minHMACKeyLength)
+	}
+	return &SigningKey{ID: id, Algorithm: AlgHS256, method: jwt.SigningMethodHS256, private: secret, public: secret}, nil
+}
+
+// Function to parse a PEM private key and check it matches the algorithm
+func privateKey(id, algorithm string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q, a private key is required", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{ID: id, Algorithm: algorithm, private: parsed}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		if algorithm != AlgRS256 {
+			break
+		}
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits")
+		}
+		key.method, key.public = jwt.SigningMethodRS256, &k.PublicKey
+	case *ecdsa.PrivateKey:
+		if algorithm != AlgES256 {
+			break
+		}
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s requires a P-256 key", AlgES256)
+		}
+		key.method, key.public = jwt.SigningMethodES256, &k.PublicKey
+	case ed25519.PrivateKey:
+		if algorithm != AlgEdDSA {
+			break
+		}
+		key.method, key.public = jwt.SigningMethodEdDSA, k.Public()
+	}
+	if key.method == nil {
+		return nil, fmt.Errorf("a %T does not match algorithm %q (use %s)", parsed, algorithm, strings.Join(Algorithms, ", "))
+	}
+	return key, nil
+}
+
+// GenerateKey creates new key material for an algorithm: a PKCS #8 PEM private
+// key, or a random secret for HS256
+func GenerateKey(algorithm string) ([]byte, error) {
+	var private interface{}
+	var err error
+	switch algorithm {
+	case AlgHS256:
+		return []byte(generateRandomString(64) + "\n"), nil
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 3072)
+	case AlgES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q (use %s)", algorithm, strings.Join(Algorithms, ", "))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Function to sign claims with the active key, the kid header names the key
+func (set *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(set.Active.method, claims)
+	token.Header["kid"] = set.Active.ID
+	return token.SignedString(set.Active.private)
+}
+
+// Function to find the verification key of a token. The algorithm of the key
+// is enforced so a token cannot pick a weaker one (e.g. HS256 with a public key).
+func (set *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	if set == nil {
+		return nil, fmt.Errorf("no signing keys configured")
+	}
+
+	var key *SigningKey
+	if kid, ok := token.Header["kid"].(string); ok {
+		key = set.Keys[kid]
+		if key == nil {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+	} else if set.Active.Algorithm == AlgHS256 {
+		// Tokens issued before kid was added
+		key = set.Active
+	} else {
+		return nil, fmt.Errorf("token has no kid")
+	}
+
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
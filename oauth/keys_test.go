@@ -0,0 +1,133 @@
+package oauth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testHMACSecret = "0123456789abcdef0123456789abcdef"
+
+// Function to write a new key of an algorithm to a temporary PEM file
+func writeTestKey(t *testing.T, algorithm string) string {
+	t.Helper()
+	data, err := GenerateKey(algorithm)
+	if err != nil {
+		t.Fatalf("GenerateKey(%s): %v", algorithm, err)
+	}
+	file := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadKeySet(t *testing.T) {
+	es := writeTestKey(t, AlgES256)
+
+	tests := []struct {
+		name       string
+		configs    []KeyConfig
+		secret     string
+		wantActive string
+		wantErr    string
+	}{
+		{"single key is active", []KeyConfig{{ID: "es", Algorithm: AlgES256, File: es}}, "", "es", ""},
+		{"legacy secret", nil, testHMACSecret, legacyKeyID(testHMACSecret), ""},
+		{"legacy secret only verifies", []KeyConfig{{ID: "es", Algorithm: AlgES256, File: es}}, testHMACSecret, "es", ""},
+		{"no key", nil, "", "", "no signing key"},
+		{"none active", []KeyConfig{{ID: "a", Algorithm: AlgES256, File: es}, {ID: "b", Algorithm: AlgHS256, Secret: testHMACSecret}}, "", "", "no signing key is marked active"},
+		{"both active", []KeyConfig{{ID: "a", Algorithm: AlgES256, File: es, Active: true}, {ID: "b", Algorithm: AlgHS256, Secret: testHMACSecret, Active: true}}, "", "", "both active"},
+		{"duplicate kid", []KeyConfig{{ID: "a", Algorithm: AlgES256, File: es, Active: true}, {ID: "a", Algorithm: AlgHS256, Secret: testHMACSecret}}, "", "", "duplicate"},
+		{"short secret", []KeyConfig{{ID: "hs", Algorithm: AlgHS256, Secret: "short"}}, "", "", "at least"},
+		{"algorithm mismatch", []KeyConfig{{ID: "rs", Algorithm: AlgRS256, File: es}}, "", "", "does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := LoadKeySet(tt.configs, tt.secret)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadKeySet() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadKeySet(): %v", err)
+			}
+			if set.Active.ID != tt.wantActive {
+				t.Errorf("active key = %q, want %q", set.Active.ID, tt.wantActive)
+			}
+		})
+	}
+}
+
+// Function to sign test claims with a method, key material and an optional kid
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("signing test token: %v", err)
+	}
+	return signed
+}
+
+func TestKeyFunc(t *testing.T) {
+	asymmetric, err := LoadKeySet([]KeyConfig{
+		{ID: "es", Algorithm: AlgES256, File: writeTestKey(t, AlgES256), Active: true},
+	}, testHMACSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := LoadKeySet(nil, testHMACSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es := asymmetric.Keys["es"]
+	der, err := x509.MarshalPKIXPublicKey(es.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	tests := []struct {
+		name    string
+		set     *KeySet
+		token   string
+		wantErr string
+	}{
+		{"asymmetric key", asymmetric, signTestToken(t, jwt.SigningMethodES256, es.private, "es"), ""},
+		{"hmac key by kid", asymmetric, signTestToken(t, jwt.SigningMethodHS256, []byte(testHMACSecret), legacyKeyID(testHMACSecret)), ""},
+		{"HS256 header with the public key", asymmetric, signTestToken(t, jwt.SigningMethodHS256, publicPEM, "es"), "unexpected signing method"},
+		{"HS256 header with the public key DER", asymmetric, signTestToken(t, jwt.SigningMethodHS256, der, "es"), "unexpected signing method"},
+		{"unknown kid", asymmetric, signTestToken(t, jwt.SigningMethodES256, es.private, "other"), "unknown kid"},
+		{"missing kid", asymmetric, signTestToken(t, jwt.SigningMethodES256, es.private, ""), "no kid"},
+		{"missing kid with the HMAC secret", asymmetric, signTestToken(t, jwt.SigningMethodHS256, []byte(testHMACSecret), ""), "no kid"},
+		{"missing kid on a legacy token", legacy, signTestToken(t, jwt.SigningMethodHS256, []byte(testHMACSecret), ""), ""},
+		{"no keys", nil, signTestToken(t, jwt.SigningMethodHS256, []byte(testHMACSecret), ""), "no signing keys"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := jwt.Parse(tt.token, tt.set.keyFunc, jwt.WithValidMethods(Algorithms))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Parse(): %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Parse() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
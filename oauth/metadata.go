@@ -0,0 +1,142 @@
+// Package oauth - metadata.go - The public keys and server metadata verifiers discover.
+package oauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+)
+
+// Paths of the token endpoints and the discovery documents
+const (
+	RevokePath     = "/revoke"
+	IntrospectPath = "/introspect"
+	JWKSPath       = "/.well-known/jwks.json"
+	MetadataPath   = "/.well-known/oauth-authorization-server"
+)
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served at JWKSPath
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// ServerMetadata is the authorization server metadata (RFC 8414)
+type ServerMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	RevocationAuthMethodsSupported    []string `json:"revocation_endpoint_auth_methods_supported"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	IntrospectionAuthMethodsSupported []string `json:"introspection_endpoint_auth_methods_supported"`
+}
+
+// Function to encode bytes for a JWK member
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// JWK returns the public JSON Web Key of an asymmetric key, false for HS256
+// whose secret must never be published
+func (key *SigningKey) JWK() (JWK, bool) {
+	jwk := JWK{KeyID: key.ID, Algorithm: key.Algorithm, Use: "sig"}
+	switch public := key.PublicKey().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = b64(public.N.Bytes())
+		jwk.E = b64(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType, jwk.Curve = "EC", public.Curve.Params().Name
+		jwk.X = b64(public.X.FillBytes(make([]byte, size)))
+		jwk.Y = b64(public.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.KeyType, jwk.Curve = "OKP", "Ed25519"
+		jwk.X = b64(public)
+	default:
+		return JWK{}, false
+	}
+	return jwk, true
+}
+
+// Function to get the issuer identifier of this server, from the config and never from the request
+func issuer() string {
+	return currentSettings().Issuer
+}
+
+// Function to write a public discovery document, verifiers may cache it briefly
+func writeDiscovery(w http.ResponseWriter, r *http.Request, body interface{}) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error writing %s: %v", r.URL.Path, err)
+	}
+}
+
+// Function to serve the public keys tokens are verified with, every asymmetric key including the inactive ones
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	set := JWKSet{Keys: []JWK{}}
+	if keys := currentSettings().Keys; keys != nil {
+		for _, key := range keys.Keys {
+			if jwk, ok := key.JWK(); ok {
+				set.Keys = append(set.Keys, jwk)
+			}
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+	writeDiscovery(w, r, set)
+}
+
+// Function to serve the authorization server metadata (RFC 8414).
+// The URLs come only from the configured issuer, never from the Host header, since
+// the document may be cached and points verifiers at the keys to trust.
+func MetadataHandler(w http.ResponseWriter, r *http.Request) {
+	base := issuer()
+	if base == "" {
+		http.Error(w, "Not found: configure issuer to publish the server metadata", http.StatusNotFound)
+		return
+	}
+	authMethods := []string{"client_secret_basic", "client_secret_post"}
+	metadata := ServerMetadata{
+		Issuer:                            base,
+		TokenEndpoint:                     base + "/token",
+		JWKSURI:                           base + JWKSPath,
+		GrantTypesSupported:               []string{"client_credentials"},
+		ResponseTypesSupported:            []string{},
+		TokenEndpointAuthMethodsSupported: authMethods,
+		ScopesSupported:                   currentSettings().Scopes,
+		RevocationEndpoint:                base + RevokePath,
+		RevocationAuthMethodsSupported:    authMethods,
+		IntrospectionEndpoint:             base + IntrospectPath,
+		IntrospectionAuthMethodsSupported: authMethods,
+	}
+	writeDiscovery(w, r, metadata)
+}
@@ -4,94 +4,321 @@
 package oauth
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/shadowbq/simple-node-health/audit"
-	"github.com/spf13/viper"
+	"github.com/shadowbq/simple-node-health/metrics"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Client struct {
-	ClientID     string `mapstructure:"client_id"`
-	ClientSecret string `mapstructure:"client_secret"`
+	ClientID              string        `mapstructure:"client_id"`
+	ClientSecret          string        `mapstructure:"client_secret"`           // Plaintext, deprecated in favour of the hash
+	ClientSecretHash      string        `mapstructure:"client_secret_hash"`      // bcrypt
+	PreviousSecretHash    string        `mapstructure:"previous_secret_hash"`    // Still accepted until PreviousSecretExpires after a rotation
+	PreviousSecretExpires string        `mapstructure:"previous_secret_expires"` // RFC 3339
+	CreatedAt             string        `mapstructure:"created_at"`              // RFC 3339
+	Scopes                []string      `mapstructure:"scopes"`
+	TokenLifetime         time.Duration `mapstructure:"token_lifetime"` // Overrides the default token lifetime
 }
 
 type Claims struct {
 	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"` // Space separated, empty for clients without scopes
 	jwt.RegisteredClaims
 }
 
-var Clients []Client
+// Settings are the clients and token settings in use, swapped as a whole when the config is reloaded
+type Settings struct {
+	Clients        []Client
+	Keys           *KeySet
+	Scopes         []string // Every scope the routes can require
+	Issuer         string   // Base URL of the server, iss of issued and accepted tokens
+	Audience       string   // aud of issued and accepted tokens, empty for the issuer
+	Lifetime       time.Duration
+	Leeway         time.Duration // Clock skew allowed when checking exp, nbf and iat
+	StateFile      string        // Where client usage is recorded, empty disables it
+	RevocationFile string        // Where revoked tokens and clients are recorded, empty disables revocation
+	RateLimit      RateLimit
+}
+
+var current atomic.Pointer[Settings]
 
-var authTokenSecret string
+// Configure replaces the settings used by the token endpoint and middleware
+func Configure(settings Settings) {
+	current.Store(&settings)
+}
 
-// Function GenerateJWT creates a new JWT token
-func generateJWT(clientID string, authTokenSecret string) (string, error) {
-	// Define your claims
-	claims := jwt.MapClaims{
-		"client_id": clientID,
-		"exp":       time.Now().Add(time.Hour).Unix(), // Token expires in 1 hour
+// Function to get the settings in use, empty until Configure is called
+func currentSettings() *Settings {
+	if s := current.Load(); s != nil {
+		return s
 	}
+	return &Settings{}
+}
 
-	// Create a new JWT token with the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+// Function to find a configured client
+func lookupClient(clientID string) (Client, bool) {
+	for _, client := range currentSettings().Clients {
+		if client.ClientID == clientID {
+			return client, true
+		}
+	}
+	return Client{}, false
+}
 
-	// Sign the token with the secret
-	tokenString, err := token.SignedString([]byte(authTokenSecret))
+// Function to get the audience of tokens, the configured one or the issuer
+func audience() string {
+	if configured := currentSettings().Audience; configured != "" {
+		return configured
+	}
+	return issuer()
+}
+
+// Function to get the lifetime of the tokens of a client
+func tokenLifetime(client Client) time.Duration {
+	if client.TokenLifetime > 0 {
+		return client.TokenLifetime
+	}
+	if lifetime := currentSettings().Lifetime; lifetime > 0 {
+		return lifetime
+	}
+	return time.Hour
+}
+
+// Function GenerateJWT creates a new JWT token for a client, bound to this server by iss and aud
+func generateJWT(client Client, scopes []string, keys *KeySet) (string, *Claims, error) {
+	now := time.Now()
+	claims := &Claims{
+		ClientID: client.ClientID,
+		Scope:    strings.Join(scopes, " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer(),
+			Subject:   client.ClientID,
+			Audience:  jwt.ClaimStrings{audience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(tokenLifetime(client))),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        generateRandomString(32), // jti
+		},
+	}
+
+	if keys == nil {
+		return "", nil, fmt.Errorf("no signing key configured")
+	}
+
+	// Sign the token with the active key
+	tokenString, err := keys.sign(claims)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	return tokenString, nil
+	return tokenString, claims, nil
 }
 
 // Function to validate client credentials
 func validateClientCredentials(clientID, clientSecret string) bool {
 
-	if err := viper.UnmarshalKey("clients", &Clients); err != nil {
-		log.Fatalf("Error reading clients from config: %s", err)
-	}
+	clients := currentSettings().Clients
 	// Log out the clients size
-	log.Printf(fmt.Sprintf("Clients size: %d", len(Clients))) // Verbose logging
+	log.Printf("Clients size: %d", len(clients)) // Verbose logging
 
-	for _, client := range Clients {
-		if client.ClientID == clientID && client.ClientSecret == clientSecret {
-			return true
+	for _, client := range clients {
+		if subtle.ConstantTimeCompare([]byte(client.ClientID), []byte(clientID)) == 1 {
+			return client.verifySecret(clientSecret)
 		}
 	}
+
+	// Spend the same time on unknown clients as on a wrong secret
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(clientSecret))
 	return false
 }
 
-// Function to handle Token and call generator for JWT token
-func TokenHandler(w http.ResponseWriter, r *http.Request) {
-	clientID := r.FormValue("client_id")
-	clientSecret := r.FormValue("client_secret")
-	log.Printf(fmt.Sprintf("Route requested: %s by client_id: %s:%s at %s", r.URL.Path, clientID, clientSecret, time.Now().Format(time.RFC3339))) // Verbose logging
+// TokenResponse is the successful response of the token endpoint (RFC 6749 section 5.1)
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// TokenError is the error response of the token endpoint (RFC 6749 section 5.2)
+type TokenError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// Function to write a token endpoint response, which must never be cached
+func writeTokenResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Function to write a token endpoint error
+func writeTokenError(w http.ResponseWriter, status int, code, description string) {
+	writeTokenResponse(w, status, TokenError{Error: code, ErrorDescription: description})
+}
+
+// Function to get the client credentials from HTTP Basic authentication or the
+// form body. Using both is an error (RFC 6749 section 2.3).
+func clientCredentials(r *http.Request) (clientID, clientSecret string, basic bool, err error) {
+	formID, formSecret := r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+
+	basicID, basicSecret, basic := r.BasicAuth()
+	if !basic {
+		return formID, formSecret, false, nil
+	}
+	if formSecret != "" {
+		return "", "", true, fmt.Errorf("client credentials given both in the Authorization header and the body")
+	}
+
+	// Basic credentials are form encoded before base64 (RFC 6749 section 2.3.1)
+	if clientID, err = url.QueryUnescape(basicID); err != nil {
+		return "", "", true, fmt.Errorf("malformed client_id")
+	}
+	if clientSecret, err = url.QueryUnescape(basicSecret); err != nil {
+		return "", "", true, fmt.Errorf("malformed client_secret")
+	}
+	return clientID, clientSecret, true, nil
+}
+
+// Function to decide the scopes of a token: the requested scopes, which must be
+// known and granted to the client, or every scope of the client
+func grantScopes(client Client, requested string) ([]string, error) {
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return client.Scopes, nil
+	}
+
+	for _, scope := range scopes {
+		if !slices.Contains(currentSettings().Scopes, scope) {
+			return nil, fmt.Errorf("unknown scope %s", scope)
+		}
+		if len(client.Scopes) > 0 && !scopeGranted(client.Scopes, scope) {
+			return nil, fmt.Errorf("scope %s is not granted to the client", scope)
+		}
+	}
+	return scopes, nil
+}
+
+// Function to authenticate the client calling an endpoint (RFC 6749 section 2.3),
+// writes the error response when it fails
+func authenticateClient(w http.ResponseWriter, r *http.Request) (Client, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeTokenError(w, http.StatusMethodNotAllowed, "invalid_request", "the endpoint only accepts POST")
+		return Client{}, false
+	}
+	if err := r.ParseForm(); err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+		return Client{}, false
+	}
+
+	clientID, clientSecret, basic, err := clientCredentials(r)
+	log.Printf("Route requested: %q by client_id: %q at %s", r.URL.Path, clientID, time.Now().Format(time.RFC3339)) // Verbose logging
+
+	// Rate limited and locked out sources and clients are refused before the secret is checked
+	if wait := allowAttempt(r, clientID); wait > 0 {
+		metrics.TokenRequestsLimited.Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeTokenError(w, http.StatusTooManyRequests, "temporarily_unavailable", "too many requests, retry later")
+		return Client{}, false
+	}
+
+	if err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return Client{}, false
+	}
 
 	if !validateClientCredentials(clientID, clientSecret) {
-		log.Printf(fmt.Sprintf("Invalid client credentials: %s:%s", clientID, clientSecret)) // Verbose logging
-		http.Error(w, "Invalid client credentials", http.StatusUnauthorized)
+		log.Printf("Invalid client credentials for client_id: %q", clientID) // Verbose logging
+		for _, lockout := range recordFailure(r, clientID) {
+			audit.AuditLog(fmt.Sprintf("Lockout: %s %q locked out for %s after %d failed authentications, last from %s at %s", lockout.Kind, lockout.Key, lockout.Duration, lockout.Failures, audit.RequestSource(r), time.Now().Format(time.RFC3339)))
+		}
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="simple-node-health"`)
+		}
+		writeTokenError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return Client{}, false
+	}
+
+	recordSuccess(r, clientID)
+	client, _ := lookupClient(clientID)
+	return client, true
+}
+
+// Function to handle the client credentials grant (RFC 6749 section 4.4) and issue a JWT token
+func TokenHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	clientID := client.ClientID
+
+	switch grantType := r.PostFormValue("grant_type"); grantType {
+	case "client_credentials":
+	case "":
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "grant_type is required")
+		return
+	default:
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type", "only the client_credentials grant is supported")
+		return
+	}
+
+	scopes, err := grantScopes(client, r.PostFormValue("scope"))
+	if err != nil {
+		audit.AuditLog(fmt.Sprintf("Token refused to client_id: %s from %s: %v", clientID, audit.RequestSource(r), err))
+		writeTokenError(w, http.StatusBadRequest, "invalid_scope", err.Error())
 		return
 	}
 
-	token, err := generateJWT(clientID, authTokenSecret)
+	token, claims, err := generateJWT(client, scopes, currentSettings().Keys)
 	if err != nil {
-		log.Printf(fmt.Sprintf("Error generating token: %v", err)) // Verbose logging
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		log.Printf("Error generating token: %v", err) // Verbose logging
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "error generating token")
 		return
 	}
 
 	// Log token issuance
-	audit.AuditLog(fmt.Sprintf("Token issued to client_id: %s at %s", clientID, time.Now().Format(time.RFC3339)))
+	recordClientUse(clientID)
+	metrics.TokensIssued.WithLabelValues(clientID).Inc()
+	audit.AuditLog(fmt.Sprintf("Token issued to client_id: %s with scopes [%s] from %s at %s", clientID, strings.Join(scopes, " "), audit.RequestSource(r), time.Now().Format(time.RFC3339)))
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"access_token": "%s", "token_type": "Bearer", "expires_in": 3600}`, token)
+	writeTokenResponse(w, http.StatusOK, TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(claims.ExpiresAt.Sub(claims.IssuedAt.Time).Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	})
+}
+
+// Function to verify a token issued by this server: its signature, issuer,
+// audience and validity window. Tokens of another snh node have another issuer and audience.
+func parseToken(tokenString string, claims *Claims) (*jwt.Token, error) {
+	settings := currentSettings()
+	return jwt.ParseWithClaims(tokenString, claims, settings.Keys.keyFunc,
+		jwt.WithValidMethods(Algorithms),
+		jwt.WithIssuer(issuer()),
+		jwt.WithAudience(audience()),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(settings.Leeway))
 }
 
 // Function to handle HTTP token authentication
@@ -101,6 +328,7 @@ func TokenAuthMiddleware(next http.Handler) http.Handler {
 
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
+			metrics.AuthFailures.WithLabelValues("no_token").Inc()
 			http.Error(w, "Unauthorized: No token provided", http.StatusUnauthorized)
 			return
 		}
@@ -110,24 +338,29 @@ func TokenAuthMiddleware(next http.Handler) http.Handler {
 
 		//audit.AuditLog(fmt.Sprintf("Route accessed: %s by client_id: %s at %s", r.URL.Path, claims.ClientID, time.Now().Format(time.RFC3339)))
 
-		// Parse the token
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			// Ensure the signing method is HMAC (HS256)
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(authTokenSecret), nil
-		})
+		// Parse the token, the kid header selects the verification key
+		token, err := parseToken(tokenString, claims)
 
 		// Improved error handling for token parsing
 		if err != nil {
 			if errors.Is(err, jwt.ErrTokenExpired) {
+				metrics.AuthFailures.WithLabelValues("expired").Inc()
 				audit.AuditLog(fmt.Sprintf("Unauthorized: Token expired: %s", err))
 				http.Error(w, "Unauthorized: Token expired", http.StatusUnauthorized)
+			} else if errors.Is(err, jwt.ErrTokenInvalidIssuer) || errors.Is(err, jwt.ErrTokenInvalidAudience) {
+				metrics.AuthFailures.WithLabelValues("wrong_audience").Inc()
+				audit.AuditLog(fmt.Sprintf("Unauthorized: Token issued for another server from %s: %s", audit.RequestSource(r), err))
+				http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+			} else if errors.Is(err, jwt.ErrTokenNotValidYet) || errors.Is(err, jwt.ErrTokenUsedBeforeIssued) {
+				metrics.AuthFailures.WithLabelValues("not_yet_valid").Inc()
+				audit.AuditLog(fmt.Sprintf("Unauthorized: Token not valid yet: %s", err))
+				http.Error(w, "Unauthorized: Token not valid yet", http.StatusUnauthorized)
 			} else if errors.Is(err, jwt.ErrTokenMalformed) || errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+				metrics.AuthFailures.WithLabelValues("invalid").Inc()
 				audit.AuditLog(fmt.Sprintf("Unauthorized: Invalid token: %s", err))
 				http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
 			} else {
+				metrics.AuthFailures.WithLabelValues("parse_error").Inc()
 				audit.AuditLog(fmt.Sprintf("Unauthorized: Token parsing error: %s", err))
 				http.Error(w, "Unauthorized: Token parsing error", http.StatusUnauthorized)
 			}
@@ -136,14 +369,41 @@ func TokenAuthMiddleware(next http.Handler) http.Handler {
 
 		// Check if the token is valid
 		if !token.Valid {
+			metrics.AuthFailures.WithLabelValues("invalid").Inc()
 			audit.AuditLog("Unauthorized: Invalid token")
 			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
 			return
 		}
 
+		// Tokens of revoked clients stop working before they expire
+		if _, ok := lookupClient(claims.ClientID); !ok || claims.Subject != claims.ClientID {
+			metrics.AuthFailures.WithLabelValues("unknown_client").Inc()
+			audit.AuditLog(fmt.Sprintf("Unauthorized: Token of unknown client_id: %s from %s", claims.ClientID, audit.RequestSource(r)))
+			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		// Revoked tokens, also every token issued to a client before it was revoked
+		revoked, err := isRevoked(claims)
+		if err != nil {
+			// Fail closed, a revoked token must never pass because the list cannot be read
+			log.Printf("Error reading revocations: %v", err)
+			metrics.AuthFailures.WithLabelValues("revocations_unavailable").Inc()
+			audit.AuditLog(fmt.Sprintf("Unauthorized: Revocations unreadable, refused token of client_id: %s from %s: %v", claims.ClientID, audit.RequestSource(r), err))
+			http.Error(w, "Service Unavailable: Token revocations cannot be read", http.StatusServiceUnavailable)
+			return
+		}
+		if revoked {
+			metrics.AuthFailures.WithLabelValues("revoked").Inc()
+			audit.AuditLog(fmt.Sprintf("Unauthorized: Revoked token of client_id: %s from %s", claims.ClientID, audit.RequestSource(r)))
+			http.Error(w, "Unauthorized: Token revoked", http.StatusUnauthorized)
+			return
+		}
+
 		// Log access to a protected route
-		audit.AuditLog(fmt.Sprintf("Route accessed: %s by client_id: %s at %s", r.URL.Path, claims.ClientID, time.Now().Format(time.RFC3339)))
+		audit.AuditLog(fmt.Sprintf("Route accessed: %s by client_id: %s from %s at %s", r.URL.Path, claims.ClientID, audit.RequestSource(r), time.Now().Format(time.RFC3339)))
 
-		next.ServeHTTP(w, r)
+		// The routes check the scopes of the token
+		next.ServeHTTP(w, withClaims(r, claims))
 	})
 }
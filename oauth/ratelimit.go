@@ -0,0 +1,229 @@
+// Package oauth - ratelimit.go - Rate limits and lockouts of the endpoints clients authenticate at.
+package oauth
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit are the limits of /token, /revoke and /introspect
+type RateLimit struct {
+	RequestsPerMinute int           // Requests from one source IP, 0 for no limit
+	MaxFailures       int           // Failed authentications of a source IP or client_id before it is locked out, 0 for no lockouts
+	Lockout           time.Duration // First lockout, doubled for every further failure
+	MaxLockout        time.Duration // Longest lockout, failures are forgotten after this long
+	TrustedProxies    []*net.IPNet  // Proxies whose X-Forwarded-For names the source of a request
+}
+
+// attempts is what the limiter tracks about a source IP or client_id
+type attempts struct {
+	tokens      float64 // Requests left, refilled continuously
+	refilled    time.Time
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	lastSeen    time.Time
+}
+
+// verifiedTTL is how long a source IP a client authenticated from is spared the lockouts of its client_id
+const verifiedTTL = 24 * time.Hour
+
+// Lockout describes a source IP, a client_id from a source IP, or a client_id from every source that was just locked out
+type Lockout struct {
+	Kind     string // "source", "client_id from source" or "client_id"
+	Key      string // The source IP, the client_id and source IP, or the client_id
+	Failures int
+	Duration time.Duration
+}
+
+// limiter keeps its state across config reloads, only the limits come from the settings.
+// A client_id is tracked per source IP and over every source together. Since a
+// client_id is not secret, the lockout over every source spares the source IPs the
+// client authenticated from, so failures from elsewhere cannot lock out the real client.
+var limiter = struct {
+	sync.Mutex
+	sources   map[string]*attempts
+	clients   map[string]*attempts // by clientKey
+	clientIDs map[string]*attempts // by client_id, failures from every source
+	verified  map[string]time.Time // by clientKey, last successful authentication
+	swept     time.Time
+}{sources: map[string]*attempts{}, clients: map[string]*attempts{}, clientIDs: map[string]*attempts{}, verified: map[string]time.Time{}}
+
+// Function to get the IP address a request comes from. Behind a trusted proxy it is
+// the last address in X-Forwarded-For that is not a trusted proxy itself.
+func sourceIP(r *http.Request) string {
+	source := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		source = host
+	}
+
+	trusted := currentSettings().RateLimit.TrustedProxies
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && trustedProxy(trusted, source); i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		source = ip.String()
+	}
+	return source
+}
+
+// Function to check an address is one of the trusted proxies
+func trustedProxy(trusted []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	for _, network := range trusted {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to get the key a client_id is tracked by from a source IP
+func clientKey(clientID, source string) string {
+	return clientID + " from " + source
+}
+
+// Function to get the tracked attempts of a key, created on first use
+func trackAttempts(tracked map[string]*attempts, key string, now time.Time) *attempts {
+	entry, ok := tracked[key]
+	if !ok {
+		entry = &attempts{tokens: math.Inf(1), refilled: now}
+		tracked[key] = entry
+	}
+	entry.lastSeen = now
+	return entry
+}
+
+// Function to forget the keys that are neither locked out nor have recent failures or requests
+func sweepAttempts(limits RateLimit, now time.Time) {
+	if now.Sub(limiter.swept) < time.Minute {
+		return
+	}
+	limiter.swept = now
+
+	idle := limits.MaxLockout
+	if idle < time.Minute {
+		idle = time.Minute
+	}
+	for _, tracked := range []map[string]*attempts{limiter.sources, limiter.clients, limiter.clientIDs} {
+		for key, entry := range tracked {
+			if now.Sub(entry.lastSeen) > idle && now.After(entry.lockedUntil) {
+				delete(tracked, key)
+			}
+		}
+	}
+	for key, verified := range limiter.verified {
+		if now.Sub(verified) > verifiedTTL {
+			delete(limiter.verified, key)
+		}
+	}
+}
+
+// Function to check a request may try to authenticate, returns how long to wait when it may not
+func allowAttempt(r *http.Request, clientID string) time.Duration {
+	limits := currentSettings().RateLimit
+	now := time.Now()
+
+	limiter.Lock()
+	defer limiter.Unlock()
+	sweepAttempts(limits, now)
+
+	ip := sourceIP(r)
+	source := trackAttempts(limiter.sources, ip, now)
+	if now.Before(source.lockedUntil) {
+		return source.lockedUntil.Sub(now)
+	}
+	if clientID != "" {
+		key := clientKey(clientID, ip)
+		if client, ok := limiter.clients[key]; ok && now.Before(client.lockedUntil) {
+			return client.lockedUntil.Sub(now)
+		}
+		_, verified := limiter.verified[key]
+		if client, ok := limiter.clientIDs[clientID]; ok && now.Before(client.lockedUntil) && !verified {
+			return client.lockedUntil.Sub(now)
+		}
+	}
+
+	// Token bucket of the source, holding a minute of requests
+	if limits.RequestsPerMinute > 0 {
+		capacity := float64(limits.RequestsPerMinute)
+		perSecond := capacity / 60
+		source.tokens = math.Min(capacity, source.tokens+now.Sub(source.refilled).Seconds()*perSecond)
+		source.refilled = now
+		if source.tokens < 1 {
+			return time.Duration((1 - source.tokens) / perSecond * float64(time.Second))
+		}
+		source.tokens--
+	}
+	return 0
+}
+
+// Function to record a failed authentication, returns the lockouts it caused
+func recordFailure(r *http.Request, clientID string) []Lockout {
+	limits := currentSettings().RateLimit
+	if limits.MaxFailures <= 0 || limits.Lockout <= 0 {
+		return nil
+	}
+	now := time.Now()
+
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	var lockouts []Lockout
+	ip := sourceIP(r)
+	keys := []struct {
+		kind, key string
+		tracked   map[string]*attempts
+	}{
+		{"source", ip, limiter.sources},
+		{"client_id from source", clientKey(clientID, ip), limiter.clients},
+		{"client_id", clientID, limiter.clientIDs},
+	}
+	for _, k := range keys {
+		if k.kind != "source" && clientID == "" {
+			continue
+		}
+		entry := trackAttempts(k.tracked, k.key, now)
+
+		// Failures are forgotten after a quiet period as long as the longest lockout
+		last := entry.lastFailure
+		if entry.lockedUntil.After(last) {
+			last = entry.lockedUntil
+		}
+		if now.Sub(last) > limits.MaxLockout {
+			entry.failures = 0
+		}
+		entry.failures++
+		entry.lastFailure = now
+
+		if entry.failures < limits.MaxFailures {
+			continue
+		}
+		// Exponential backoff: the lockout doubles with every failure past the limit
+		lockout := limits.Lockout << min(entry.failures-limits.MaxFailures, 30)
+		if lockout <= 0 || (limits.MaxLockout > 0 && lockout > limits.MaxLockout) {
+			lockout = limits.MaxLockout
+		}
+		entry.lockedUntil = now.Add(lockout)
+		lockouts = append(lockouts, Lockout{Kind: k.kind, Key: k.key, Failures: entry.failures, Duration: lockout})
+	}
+	return lockouts
+}
+
+// Function to forget the failures of a client from a source after it authenticated and
+// spare the source the lockouts of the client_id. The failures of the source itself and
+// of the client_id over every source are kept so a valid client cannot reset them.
+func recordSuccess(r *http.Request, clientID string) {
+	key := clientKey(clientID, sourceIP(r))
+
+	limiter.Lock()
+	defer limiter.Unlock()
+	delete(limiter.clients, key)
+	limiter.verified[key] = time.Now()
+}
@@ -0,0 +1,55 @@
+package oauth
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSourceIP(t *testing.T) {
+	var trusted []*net.IPNet
+	for _, cidr := range []string{"127.0.0.1/32", "10.0.0.0/8"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted = append(trusted, network)
+	}
+	t.Cleanup(func() { current.Store(nil) })
+
+	tests := []struct {
+		name      string
+		trusted   []*net.IPNet
+		remote    string
+		forwarded []string // X-Forwarded-For headers
+		want      string
+	}{
+		{"no proxies", nil, "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"no port", nil, "192.0.2.1", nil, "192.0.2.1"},
+		{"spoofed without trusted proxies", nil, "192.0.2.1:1234", []string{"198.51.100.7"}, "192.0.2.1"},
+		{"spoofed from an untrusted peer", trusted, "192.0.2.1:1234", []string{"198.51.100.7"}, "192.0.2.1"},
+		{"trusted proxy", trusted, "127.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"trusted proxy without header", trusted, "127.0.0.1:1234", nil, "127.0.0.1"},
+		{"spoofed entry before the client", trusted, "127.0.0.1:1234", []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{"chained trusted proxies", trusted, "127.0.0.1:1234", []string{"198.51.100.7, 10.1.2.3"}, "198.51.100.7"},
+		{"chained over several headers", trusted, "127.0.0.1:1234", []string{"203.0.113.9", "198.51.100.7, 10.1.2.3"}, "198.51.100.7"},
+		{"only trusted proxies", trusted, "127.0.0.1:1234", []string{"10.1.2.3, 10.4.5.6"}, "10.1.2.3"},
+		{"garbage after the client", trusted, "127.0.0.1:1234", []string{"198.51.100.7, not-an-ip"}, "127.0.0.1"},
+		{"garbage before the client", trusted, "127.0.0.1:1234", []string{"not-an-ip, 198.51.100.7"}, "198.51.100.7"},
+		{"IPv6 client", trusted, "127.0.0.1:1234", []string{"2001:DB8::1"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Configure(Settings{RateLimit: RateLimit{TrustedProxies: tt.trusted}})
+
+			r := httptest.NewRequest("POST", "/token", nil)
+			r.RemoteAddr = tt.remote
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := sourceIP(r); got != tt.want {
+				t.Errorf("sourceIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
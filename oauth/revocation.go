@@ -0,0 +1,182 @@
+// Package oauth - revocation.go - Revoked tokens and clients, persisted so a revocation outlives a restart.
+package oauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/shadowbq/simple-node-health/audit"
+)
+
+// Revocations are the revoked tokens by jti and the clients whose tokens are all revoked
+type Revocations struct {
+	Tokens  map[string]time.Time `json:"tokens"`  // jti to the expiry of the token, dropped once expired
+	Clients map[string]time.Time `json:"clients"` // client_id to the revocation time, tokens issued until then are rejected
+}
+
+var revocationMu sync.Mutex
+
+// revocationCache is the revocation file as last read, reread when it changes
+var revocationCache struct {
+	sync.Mutex
+	path        string
+	modTime     time.Time
+	size        int64
+	revocations *Revocations
+}
+
+// LoadRevocations reads the revocation file, a missing file has no revocations
+func LoadRevocations(path string) (*Revocations, error) {
+	revocations := &Revocations{Tokens: map[string]time.Time{}, Clients: map[string]time.Time{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return revocations, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, revocations); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if revocations.Tokens == nil {
+		revocations.Tokens = map[string]time.Time{}
+	}
+	if revocations.Clients == nil {
+		revocations.Clients = map[string]time.Time{}
+	}
+	return revocations, nil
+}
+
+// Function to change the revocation file, expired tokens are dropped on every write
+func updateRevocations(path string, update func(*Revocations)) error {
+	revocationMu.Lock()
+	defer revocationMu.Unlock()
+
+	revocations, err := LoadRevocations(path)
+	if err != nil {
+		return err
+	}
+	update(revocations)
+
+	now := time.Now()
+	for jti, expires := range revocations.Tokens {
+		if expires.Before(now) {
+			delete(revocations.Tokens, jti)
+		}
+	}
+
+	data, err := json.MarshalIndent(revocations, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStateFile(path, data)
+}
+
+// RevokeToken revokes a single token until it expires
+func RevokeToken(path, jti string, expires time.Time) error {
+	return updateRevocations(path, func(revocations *Revocations) {
+		revocations.Tokens[jti] = expires.UTC()
+	})
+}
+
+// RevokeClientTokens revokes every token issued to a client until now
+func RevokeClientTokens(path, clientID string) error {
+	return updateRevocations(path, func(revocations *Revocations) {
+		revocations.Clients[clientID] = time.Now().UTC()
+	})
+}
+
+// Function to get the revocations in use, the file is only reread after it changed.
+// An error means the file exists but cannot be read, and revoked tokens cannot be told apart.
+func currentRevocations() (*Revocations, error) {
+	path := currentSettings().RevocationFile
+	if path == "" {
+		return nil, nil
+	}
+
+	revocationCache.Lock()
+	defer revocationCache.Unlock()
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		revocationCache.path, revocationCache.revocations = path, nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if path == revocationCache.path && revocationCache.revocations != nil && info.ModTime().Equal(revocationCache.modTime) && info.Size() == revocationCache.size {
+		return revocationCache.revocations, nil
+	}
+
+	revocations, err := LoadRevocations(path)
+	if err != nil {
+		return nil, err
+	}
+	revocationCache.path, revocationCache.revocations = path, revocations
+	revocationCache.modTime, revocationCache.size = info.ModTime(), info.Size()
+	return revocations, nil
+}
+
+// Function to check a token was revoked by its jti or through its client
+func isRevoked(claims *Claims) (bool, error) {
+	revocations, err := currentRevocations()
+	if err != nil || revocations == nil {
+		return false, err
+	}
+	if _, ok := revocations.Tokens[claims.ID]; ok && claims.ID != "" {
+		return true, nil
+	}
+	if revokedAt, ok := revocations.Clients[claims.ClientID]; ok {
+		return claims.IssuedAt == nil || !claims.IssuedAt.After(revokedAt), nil
+	}
+	return false, nil
+}
+
+// Function to handle token revocation (RFC 7009), a client can revoke the tokens issued to it
+func RevokeHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	tokenString := r.PostFormValue("token")
+	if tokenString == "" {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	// Only access tokens are issued, so token_type_hint needs no lookup. Invalid
+	// and expired tokens are already unusable and answered like a revocation.
+	settings := currentSettings()
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, settings.Keys.keyFunc, jwt.WithValidMethods(Algorithms), jwt.WithoutClaimsValidation())
+	if err != nil || claims.ID == "" || claims.ExpiresAt == nil || claims.ExpiresAt.Add(settings.Leeway).Before(time.Now()) {
+		writeTokenResponse(w, http.StatusOK, struct{}{})
+		return
+	}
+
+	if claims.ClientID != client.ClientID {
+		audit.AuditLog(fmt.Sprintf("Revocation refused: client_id: %s tried to revoke a token of client_id: %s from %s", client.ClientID, claims.ClientID, audit.RequestSource(r)))
+		writeTokenError(w, http.StatusBadRequest, "unauthorized_client", "the token was not issued to the client")
+		return
+	}
+
+	if settings.RevocationFile == "" {
+		writeTokenError(w, http.StatusServiceUnavailable, "temporarily_unavailable", "token revocation is not configured")
+		return
+	}
+	if err := RevokeToken(settings.RevocationFile, claims.ID, claims.ExpiresAt.Add(settings.Leeway)); err != nil {
+		log.Printf("Error recording revocation in %s: %v", settings.RevocationFile, err)
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "error recording the revocation")
+		return
+	}
+
+	audit.AuditLog(fmt.Sprintf("Token revoked: jti: %s of client_id: %s from %s at %s", claims.ID, claims.ClientID, audit.RequestSource(r), time.Now().Format(time.RFC3339)))
+	writeTokenResponse(w, http.StatusOK, struct{}{})
+}
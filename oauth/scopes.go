@@ -0,0 +1,77 @@
+// Package oauth - scopes.go - Per-client scopes embedded in the tokens and enforced per route.
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/shadowbq/simple-node-health/audit"
+	"github.com/shadowbq/simple-node-health/metrics"
+)
+
+// Scopes granted to clients
+const (
+	ScopeCheckAll    = "check"            // The aggregate check at / and /check
+	ScopeCheckPrefix = "check:"           // check:<name> for /check/<name>, check:* for every check
+	ScopeMetricsRead = "metrics:read"     // /metrics
+	ScopeIntrospect  = "token:introspect" // Introspect the tokens of other clients
+)
+
+// claimsKey is the request context key of the verified token claims
+type claimsKey struct{}
+
+// Function to get the verified claims of a request, nil when the route is not protected
+func requestClaims(r *http.Request) *Claims {
+	claims, _ := r.Context().Value(claimsKey{}).(*Claims)
+	return claims
+}
+
+// Function to attach the verified claims to a request
+func withClaims(r *http.Request, claims *Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims))
+}
+
+// Function to check a scope is in a granted list, `prefix:*` grants every scope with that prefix
+func scopeGranted(granted []string, scope string) bool {
+	for _, g := range granted {
+		if g == scope || (strings.HasSuffix(g, ":*") && strings.HasPrefix(scope, strings.TrimSuffix(g, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the token of a request grants a scope. Requests on
+// unprotected routes (insecure mode) and tokens of clients without scopes are
+// unrestricted. The scopes in the token are limited further by the scopes the
+// client has now, so narrowing a client applies to tokens already issued.
+func HasScope(r *http.Request, scope string) bool {
+	claims := requestClaims(r)
+	if claims == nil {
+		return true
+	}
+
+	if tokenScopes := strings.Fields(claims.Scope); len(tokenScopes) > 0 && !scopeGranted(tokenScopes, scope) {
+		return false
+	}
+	if client, ok := lookupClient(claims.ClientID); ok && len(client.Scopes) > 0 && !scopeGranted(client.Scopes, scope) {
+		return false
+	}
+	return true
+}
+
+// RequireScope rejects requests whose token does not grant the scope with 403
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !HasScope(r, scope) {
+			metrics.AuthFailures.WithLabelValues("insufficient_scope").Inc()
+			audit.AuditLog(fmt.Sprintf("Forbidden: %s requires scope %s, not granted to client_id: %s from %s", r.URL.Path, scope, requestClaims(r).ClientID, audit.RequestSource(r)))
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+			http.Error(w, "Forbidden: token lacks scope "+scope, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,50 @@
+// Package oauth - secrets.go - Hashing and constant-time verification of client secrets.
+package oauth
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when the client_id is unknown, so the response
+// time does not reveal which client IDs exist
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("snh-unknown-client"), bcrypt.DefaultCost)
+
+// HashSecret returns the bcrypt hash of a client secret for the client_secret_hash field
+func HashSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// ValidSecretHash reports whether a client_secret_hash is a bcrypt hash
+func ValidSecretHash(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// Function to check a secret against a client in constant time. Clients still
+// configured with a plaintext client_secret are compared without hashing. The
+// previous secret of a rotation is accepted until its overlap period ends.
+func (client Client) verifySecret(secret string) bool {
+	if client.ClientSecretHash != "" {
+		if bcrypt.CompareHashAndPassword([]byte(client.ClientSecretHash), []byte(secret)) == nil {
+			return true
+		}
+	} else if subtle.ConstantTimeCompare([]byte(client.ClientSecret), []byte(secret)) == 1 {
+		return true
+	}
+
+	if client.PreviousSecretHash == "" {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339, client.PreviousSecretExpires)
+	if err != nil || time.Now().After(expires) {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(client.PreviousSecretHash), []byte(secret)) == nil
+}
@@ -0,0 +1,165 @@
+// Package oauth - state.go - Client usage recorded by the server outside the config file.
+package oauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ClientState is what the server records about a client
+type ClientState struct {
+	LastUsed time.Time `json:"last_used"` // Last token issued
+}
+
+var stateMu sync.Mutex
+
+// clientUseFlushInterval is how often the client use recorded in memory is written to the state file
+const clientUseFlushInterval = time.Minute
+
+// pendingUse is the client use not yet written, by state file and client_id
+var pendingUse = struct {
+	sync.Mutex
+	uses    map[string]map[string]time.Time
+	flusher sync.Once
+}{uses: map[string]map[string]time.Time{}}
+
+// LoadClientState reads the recorded state of every client, a missing file has none
+func LoadClientState(path string) (map[string]ClientState, error) {
+	state := map[string]ClientState{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// UpdateClientState changes the recorded state of a client, false removes it
+func UpdateClientState(path, clientID string, update func(*ClientState) bool) error {
+	return updateClientStates(path, func(state map[string]ClientState) {
+		entry := state[clientID]
+		if update(&entry) {
+			state[clientID] = entry
+		} else {
+			delete(state, clientID)
+		}
+	})
+}
+
+// Function to change the recorded state of any clients in one write
+func updateClientStates(path string, update func(map[string]ClientState)) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	state, err := LoadClientState(path)
+	if err != nil {
+		return err
+	}
+	update(state)
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStateFile(path, data)
+}
+
+// Function to replace a state file by rename so a crash never leaves it half written.
+// The file keeps its owner and mode, a new file gets the owner of the directory, so
+// a command run as root leaves the state readable by the service user.
+func writeStateFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	mode := os.FileMode(0o600)
+	owner, err := os.Stat(path)
+	if err == nil {
+		mode = owner.Mode().Perm()
+	} else if owner, err = os.Stat(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if st, ok := owner.Sys().(*syscall.Stat_t); ok && (int(st.Uid) != os.Geteuid() || int(st.Gid) != os.Getegid()) {
+		if err := os.Chown(tmp.Name(), int(st.Uid), int(st.Gid)); err != nil {
+			return fmt.Errorf("%s is owned by %d:%d, run as that user: %v", path, st.Uid, st.Gid, err)
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Function to record that a client was issued a token. The time is kept in memory
+// and written with every other use by the next flush, not once per token.
+func recordClientUse(clientID string) {
+	path := currentSettings().StateFile
+	if path == "" {
+		return
+	}
+
+	pendingUse.Lock()
+	if pendingUse.uses[path] == nil {
+		pendingUse.uses[path] = map[string]time.Time{}
+	}
+	pendingUse.uses[path][clientID] = time.Now().UTC()
+	pendingUse.Unlock()
+
+	pendingUse.flusher.Do(func() {
+		go func() {
+			for range time.Tick(clientUseFlushInterval) {
+				FlushClientUse()
+			}
+		}()
+	})
+}
+
+// FlushClientUse writes the client use recorded since the last flush to the state
+// files. Clients removed from the config in the meantime are not written back.
+func FlushClientUse() {
+	pendingUse.Lock()
+	uses := pendingUse.uses
+	pendingUse.uses = map[string]map[string]time.Time{}
+	pendingUse.Unlock()
+
+	for path, clients := range uses {
+		err := updateClientStates(path, func(state map[string]ClientState) {
+			for clientID, lastUsed := range clients {
+				if _, ok := lookupClient(clientID); !ok {
+					continue
+				}
+				entry := state[clientID]
+				if lastUsed.After(entry.LastUsed) {
+					entry.LastUsed = lastUsed
+					state[clientID] = entry
+				}
+			}
+		})
+		if err != nil {
+			log.Printf("Error recording client use in %s: %v", path, err)
+		}
+	}
+}
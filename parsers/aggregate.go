@@ -0,0 +1,69 @@
+package parsers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// AggregateResponse is the JSON document returned by the aggregate check
+type AggregateResponse struct {
+	State  State                  `json:"state"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Function to run every enabled check concurrently, the overall state is the worst check state
+func runAggregate(ctx context.Context, fresh bool) AggregateResponse {
+	response := AggregateResponse{State: StatePass, Checks: map[string]CheckResult{}}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range Checks() {
+		if !currentConfig().GetBool("checks." + check.Name() + ".enabled") {
+			continue
+		}
+
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+			result := resultFor(ctx, check, fresh)
+
+			mu.Lock()
+			defer mu.Unlock()
+			response.Checks[check.Name()] = result
+			response.State = worstState(response.State, result.State)
+		}(check)
+	}
+	wg.Wait()
+
+	return response
+}
+
+// ShowDetails decides whether the aggregate response of a request includes the
+// details of a check or only its state, by default always
+var ShowDetails = func(r *http.Request, check string) bool { return true }
+
+// Function to run every enabled check and return the combined result
+func HTTPCheckAll(w http.ResponseWriter, r *http.Request) {
+	// "/" is a catch-all pattern, only the root itself is the aggregate
+	if r.URL.Path != "/" && r.URL.Path != "/check" {
+		http.NotFound(w, r)
+		return
+	}
+
+	response := runAggregate(r.Context(), freshRequested(r))
+	for name, result := range response.Checks {
+		if !ShowDetails(r, name) {
+			result.Details, result.Error = nil, ""
+			response.Checks[name] = result
+		}
+	}
+	writeCheckResponse(w, response.State, response)
+}
+
+// Function to print every enabled check to console
+func CmdCheckAll(cmd *cobra.Command, args []string) {
+	printCheckResponse(runAggregate(cmd.Context(), false))
+}
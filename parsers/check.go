@@ -0,0 +1,218 @@
+package parsers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shadowbq/simple-node-health/metrics"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Check is a health check. A registered check gets a `check <name>` CLI
+// subcommand, a `/check/<name>` HTTP route and is included in the aggregate.
+type Check interface {
+	Name() string
+	Description() string
+	Run(ctx context.Context) Result
+}
+
+// RequestCheck is implemented by checks that take parameters from the HTTP
+// request. FromRequest returns the check to run, or nil to run the check as
+// configured; a rejected request returns its HTTP status code and an error.
+// Runs of a returned check are not recorded in the check metrics.
+type RequestCheck interface {
+	Check
+	FromRequest(r *http.Request) (Check, int, error)
+}
+
+// Result is the outcome of running a check, Details is the JSON document served for the check
+type Result struct {
+	State   State
+	Details interface{}
+	Err     error
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Check{}
+)
+
+// Register adds a check to the registry, registering the same name twice panics
+func Register(check Check) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[check.Name()]; exists {
+		panic(fmt.Sprintf("parsers: check %q registered twice", check.Name()))
+	}
+	registry[check.Name()] = check
+}
+
+// Checks returns the registered checks sorted by name
+func Checks() []Check {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	checks := make([]Check, 0, len(registry))
+	for _, check := range registry {
+		checks = append(checks, check)
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name() < checks[j].Name() })
+	return checks
+}
+
+// Lookup returns the registered check with the name
+func Lookup(name string) (Check, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	check, ok := registry[name]
+	return check, ok
+}
+
+// CheckResult is the outcome of one run of a check, as reported in the aggregate
+type CheckResult struct {
+	State      State       `json:"state"`
+	DurationMS float64     `json:"duration_ms"`
+	LastRun    time.Time   `json:"last_run"`
+	AgeSeconds float64     `json:"age_seconds"`
+	Details    interface{} `json:"details,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// config is the settings snapshot the checks read, replaced as a whole on every (re)load
+var config atomic.Pointer[viper.Viper]
+
+// configKey is the context key of the settings a check runs with
+type configKey struct{}
+
+// SetConfig publishes the settings the checks run with. The snapshot must not be
+// changed afterwards: a check that timed out may still be reading it after a reload.
+func SetConfig(v *viper.Viper) {
+	config.Store(v)
+}
+
+// Function to get the published settings, the global config until SetConfig is called
+func currentConfig() *viper.Viper {
+	if v := config.Load(); v != nil {
+		return v
+	}
+	return viper.GetViper()
+}
+
+// Function to get the settings a check runs with, those it was started with by runWithTimeout
+func configFrom(ctx context.Context) *viper.Viper {
+	if v, ok := ctx.Value(configKey{}).(*viper.Viper); ok {
+		return v
+	}
+	return currentConfig()
+}
+
+// Function to run a check with its timeout (`checks.<name>.timeout`, falling back to `checks.timeout`)
+func runWithTimeout(ctx context.Context, check Check) CheckResult {
+	cfg := currentConfig()
+	timeout := cfg.GetDuration("checks." + check.Name() + ".timeout")
+	if timeout <= 0 {
+		timeout = cfg.GetDuration("checks.timeout")
+	}
+	ctx = context.WithValue(ctx, configKey{}, cfg)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan Result, 1)
+
+	start := time.Now()
+	go func() {
+		done <- check.Run(ctx)
+	}()
+
+	var result CheckResult
+	select {
+	case r := <-done:
+		result = CheckResult{State: r.State, Details: r.Details}
+		if r.Err != nil {
+			result = CheckResult{State: StateFail, Error: r.Err.Error()}
+		}
+	case <-ctx.Done():
+		result = CheckResult{State: StateFail, Error: fmt.Sprintf("timed out after %s", timeout)}
+	}
+	result.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+	result.LastRun = start
+
+	return result
+}
+
+// Function to run a check with its timeout and record the result in the check metrics
+func runCheck(ctx context.Context, check Check) CheckResult {
+	start := time.Now()
+	result := runWithTimeout(ctx, check)
+	metrics.ObserveCheck(check.Name(), stateSeverity[result.State], time.Since(start))
+	return result
+}
+
+// Function to read the `fresh` query parameter that forces a scheduled check to run
+func freshRequested(r *http.Request) bool {
+	fresh, _ := strconv.ParseBool(r.URL.Query().Get("fresh"))
+	return fresh
+}
+
+// HTTPHandler returns the `/check/<name>` handler for a check. The age of a
+// cached result is reported in the Age and Last-Modified headers.
+func HTTPHandler(check Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var override Check
+		if rc, ok := check.(RequestCheck); ok {
+			var status int
+			var err error
+			if override, status, err = rc.FromRequest(r); err != nil {
+				writeRequestError(w, status, err)
+				return
+			}
+		}
+
+		var result CheckResult
+		if override != nil {
+			result = runWithTimeout(r.Context(), override)
+		} else {
+			result = resultFor(r.Context(), check, freshRequested(r))
+		}
+
+		w.Header().Set("Age", strconv.Itoa(int(result.AgeSeconds)))
+		w.Header().Set("Last-Modified", result.LastRun.UTC().Format(http.TimeFormat))
+		if result.Error != "" {
+			writeCheckError(w, fmt.Errorf("Error checking %s: %s", check.Name(), result.Error))
+			return
+		}
+		writeCheckResponse(w, result.State, result.Details)
+	}
+}
+
+// CmdRunner returns the `check <name>` command function for a check
+func CmdRunner(check Check) func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		result := check.Run(cmd.Context())
+		if result.Err != nil {
+			fmt.Printf("Error checking %s: %v\n", check.Name(), result.Err)
+			return
+		}
+		printCheckResponse(result.Details)
+	}
+}
+
+// ValidateConfig checks the check settings of a config without running any check
+func ValidateConfig(v *viper.Viper) error {
+	if _, err := loadDiskConfig(v); err != nil {
+		return err
+	}
+	if _, err := loadDNSProbes(v); err != nil {
+		return err
+	}
+	return nil
+}
@@ -1,65 +1,368 @@
 package parsers
 
 import (
+	"context"
 	"fmt"
-	"net/http"
-	"os/exec"
-	"strings"
+	"path"
 
-	"github.com/shadowbq/simple-node-health/helpers"
-	"github.com/spf13/cobra"
+	"github.com/shadowbq/simple-node-health/metrics"
+	"github.com/spf13/viper"
 )
 
-func getDisks() (string, error) {
-	cmd := exec.Command("mount")
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("Error executing mount command: %v", err)
+// DiskRule describes a mount option condition that counts as a failure
+type DiskRule struct {
+	Name       string `mapstructure:"name"`
+	Mountpoint string `mapstructure:"mountpoint"` // Glob, empty matches every mount
+	When       string `mapstructure:"when"`       // Only evaluate the rule when this option is set
+	Option     string `mapstructure:"option"`     // Fail when this option is set
+	Missing    string `mapstructure:"missing"`    // Fail when this option is not set
+}
+
+// Threshold is a pair of used percentages, zero disables the level
+type Threshold struct {
+	Warning  float64 `mapstructure:"warning"`
+	Critical float64 `mapstructure:"critical"`
+}
+
+// DiskThresholds are the space and inode usage limits for a mount
+type DiskThresholds struct {
+	Space  Threshold `mapstructure:"space"`
+	Inodes Threshold `mapstructure:"inodes"`
+}
+
+// ThresholdOverride sets levels of a threshold, a level it leaves out keeps the global value
+type ThresholdOverride struct {
+	Warning  *float64 `mapstructure:"warning"`
+	Critical *float64 `mapstructure:"critical"`
+}
+
+// DiskOverride changes the global thresholds for mountpoints matching the glob
+type DiskOverride struct {
+	Mountpoint string            `mapstructure:"mountpoint"`
+	Space      ThresholdOverride `mapstructure:"space"`
+	Inodes     ThresholdOverride `mapstructure:"inodes"`
+}
+
+// DiskConfig is the `disks` section of the config
+type DiskConfig struct {
+	MountInfo  string         `mapstructure:"mountinfo"`
+	FSTypes    []string       `mapstructure:"fstypes"`
+	Include    []string       `mapstructure:"include"`
+	Exclude    []string       `mapstructure:"exclude"`
+	Rules      []DiskRule     `mapstructure:"rules"`
+	Thresholds DiskThresholds `mapstructure:"thresholds"`
+	Overrides  []DiskOverride `mapstructure:"overrides"`
+}
+
+// Usage levels of a mount, rule violations are always critical
+const (
+	LevelOK       = "ok"
+	LevelWarning  = "warning"
+	LevelCritical = "critical"
+)
+
+// DiskReport is an evaluated mount, its usage and the names of the rules it violated
+type DiskReport struct {
+	Mount
+	Usage      *DiskUsage `json:"usage,omitempty"`
+	UsageError string     `json:"usage_error,omitempty"`
+	Level      string     `json:"level"`
+	Violations []string   `json:"violations"`
+}
+
+// DisksResponse is the JSON document returned by the disk check
+type DisksResponse struct {
+	Response   []DiskReport `json:"response"`
+	Violations int          `json:"violations"`
+	Level      string       `json:"level"`
+	State      State        `json:"state"`
+}
+
+// DefaultDiskRules is the rule set used when the config does not define any
+var DefaultDiskRules = []map[string]interface{}{
+	{"name": "read-only", "option": "ro"},
+}
+
+// Function to load the disk check settings from a config
+func loadDiskConfig(v *viper.Viper) (DiskConfig, error) {
+	// Read the keys individually so defaults still apply when the config only sets part of the section
+	cfg := DiskConfig{
+		MountInfo: v.GetString("disks.mountinfo"),
+		FSTypes:   v.GetStringSlice("disks.fstypes"),
+		Include:   v.GetStringSlice("disks.include"),
+		Exclude:   v.GetStringSlice("disks.exclude"),
+		Thresholds: DiskThresholds{
+			Space:  Threshold{Warning: v.GetFloat64("disks.thresholds.space.warning"), Critical: v.GetFloat64("disks.thresholds.space.critical")},
+			Inodes: Threshold{Warning: v.GetFloat64("disks.thresholds.inodes.warning"), Critical: v.GetFloat64("disks.thresholds.inodes.critical")},
+		},
+	}
+	if err := v.UnmarshalKey("disks.rules", &cfg.Rules); err != nil {
+		return cfg, fmt.Errorf("parsing disks rules: %v", err)
+	}
+	if err := v.UnmarshalKey("disks.overrides", &cfg.Overrides); err != nil {
+		return cfg, fmt.Errorf("parsing disks overrides: %v", err)
+	}
+
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" {
+			return cfg, fmt.Errorf("disks rule %d has no name", i)
+		}
+		if rule.Option == "" && rule.Missing == "" {
+			return cfg, fmt.Errorf("disks rule %q needs an option or missing condition", rule.Name)
+		}
 	}
 
-	lines := strings.Split(string(output), "\n")
-	var results []string
+	for _, override := range cfg.Overrides {
+		if override.Mountpoint == "" {
+			return cfg, fmt.Errorf("disks override has no mountpoint")
+		}
+	}
 
-	for _, line := range lines {
-		if strings.Contains(line, "type ext4") && strings.Contains(line, "ro,") {
-			results = append(results, line)
+	// Reject invalid globs up front rather than on the first matching mount
+	patterns := append(append([]string{}, cfg.Include...), cfg.Exclude...)
+	for _, rule := range cfg.Rules {
+		patterns = append(patterns, rule.Mountpoint)
+	}
+	for _, override := range cfg.Overrides {
+		patterns = append(patterns, override.Mountpoint)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return cfg, fmt.Errorf("disks pattern %q: %v", pattern, err)
 		}
 	}
 
-	// Check if the slice is nil and assign [""] if it is
-	if results == nil {
-		results = []string{""}
+	return cfg, nil
+}
+
+// Function to match a path against a list of globs
+func matchAny(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return false, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
 	}
+	return false, nil
+}
 
-	//return results, nil
+// Function to decide whether a mount is covered by the disk check
+func selectMount(cfg DiskConfig, mount Mount) (bool, error) {
+	fstypeMatch := false
+	for _, fstype := range cfg.FSTypes {
+		if mount.FSType == fstype {
+			fstypeMatch = true
+			break
+		}
+	}
+	if !fstypeMatch {
+		return false, nil
+	}
+
+	if len(cfg.Include) > 0 {
+		included, err := matchAny(cfg.Include, mount.MountPoint)
+		if err != nil || !included {
+			return false, err
+		}
+	}
 
-	jsonOutput, err := helpers.StringArrayToJSON(results)
+	excluded, err := matchAny(cfg.Exclude, mount.MountPoint)
 	if err != nil {
-		return "", fmt.Errorf("Error: %v", err)
+		return false, err
+	}
+	return !excluded, nil
+}
+
+// Function to evaluate every rule against a mount and return the names of the violated rules
+func evaluateRules(rules []DiskRule, mount Mount) ([]string, error) {
+	violations := []string{}
+
+	for _, rule := range rules {
+		if rule.Mountpoint != "" {
+			matched, err := path.Match(rule.Mountpoint, mount.MountPoint)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid mountpoint pattern: %v", rule.Name, err)
+			}
+			if !matched {
+				continue
+			}
+		}
+		if rule.When != "" && !mount.HasOption(rule.When) {
+			continue
+		}
+
+		if (rule.Option != "" && mount.HasOption(rule.Option)) || (rule.Missing != "" && !mount.HasOption(rule.Missing)) {
+			violations = append(violations, rule.Name)
+		}
 	}
 
-	return string(jsonOutput), nil
+	return violations, nil
 }
 
-// Function to check for EXT4 devices in read-only mode
-func HTTPCheckDisks(w http.ResponseWriter, r *http.Request) {
-	result, err := getDisks()
+// Function to set the levels of an override over a threshold
+func (o ThresholdOverride) apply(t Threshold) Threshold {
+	if o.Warning != nil {
+		t.Warning = *o.Warning
+	}
+	if o.Critical != nil {
+		t.Critical = *o.Critical
+	}
+	return t
+}
+
+// Function to find the thresholds for a mountpoint, the first matching override
+// is merged over the global thresholds
+func thresholdsFor(cfg DiskConfig, mountpoint string) (DiskThresholds, error) {
+	for _, override := range cfg.Overrides {
+		matched, err := path.Match(override.Mountpoint, mountpoint)
+		if err != nil {
+			return DiskThresholds{}, fmt.Errorf("override %q: invalid mountpoint pattern: %v", override.Mountpoint, err)
+		}
+		if matched {
+			return DiskThresholds{
+				Space:  override.Space.apply(cfg.Thresholds.Space),
+				Inodes: override.Inodes.apply(cfg.Thresholds.Inodes),
+			}, nil
+		}
+	}
+	return cfg.Thresholds, nil
+}
+
+// Function to grade a used percentage against a threshold
+func (t Threshold) level(used float64) string {
+	switch {
+	case t.Critical > 0 && used >= t.Critical:
+		return LevelCritical
+	case t.Warning > 0 && used >= t.Warning:
+		return LevelWarning
+	default:
+		return LevelOK
+	}
+}
+
+// Function to return the more severe of two levels
+func worstLevel(a, b string) string {
+	severity := map[string]int{LevelOK: 0, LevelWarning: 1, LevelCritical: 2}
+	if severity[b] > severity[a] {
+		return b
+	}
+	return a
+}
+
+// Function to map a disk level to the check state
+func levelState(level string) State {
+	switch level {
+	case LevelCritical:
+		return StateFail
+	case LevelWarning:
+		return StateWarn
+	default:
+		return StatePass
+	}
+}
+
+// Function to evaluate the configured mounts from the mount table
+func checkDisks(cfg DiskConfig) (DisksResponse, error) {
+	response := DisksResponse{Response: []DiskReport{}, Level: LevelOK}
+
+	mounts, err := ReadMountInfo(cfg.MountInfo)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error checking disks: %v\n", err), http.StatusInternalServerError)
-		return
+		return response, err
+	}
+
+	for _, mount := range mounts {
+		selected, err := selectMount(cfg, mount)
+		if err != nil {
+			return response, err
+		}
+		if !selected {
+			continue
+		}
+
+		violations, err := evaluateRules(cfg.Rules, mount)
+		if err != nil {
+			return response, err
+		}
+
+		report := DiskReport{Mount: mount, Violations: violations, Level: LevelOK}
+		if len(violations) > 0 {
+			report.Level = LevelCritical
+			response.Violations++
+		}
+
+		thresholds, err := thresholdsFor(cfg, mount.MountPoint)
+		if err != nil {
+			return response, err
+		}
+
+		// A mount that cannot be statted (e.g. a stale NFS handle) is a warning at least
+		usage, err := getDiskUsage(mount.MountPoint)
+		if err != nil {
+			report.UsageError = err.Error()
+			report.Level = worstLevel(report.Level, LevelWarning)
+		} else {
+			report.Usage = &usage
+			report.Level = worstLevel(report.Level, thresholds.Space.level(usage.SpaceUsedPercent))
+			report.Level = worstLevel(report.Level, thresholds.Inodes.level(usage.InodesUsedPercent))
+		}
+
+		response.Response = append(response.Response, report)
+		response.Level = worstLevel(response.Level, report.Level)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	//json.NewEncoder(w).Encode(results)
-	fmt.Fprintln(w, result)
+	response.State = levelState(response.Level)
+	return response, nil
 }
 
-// Function to print check disks to console
-func CmdCheckDisks(cmd *cobra.Command, args []string) {
-	response, err := getDisks()
+func getDisks(v *viper.Viper) (DisksResponse, error) {
+	cfg, err := loadDiskConfig(v)
 	if err != nil {
-		fmt.Println("Error checking Disks:", err)
-		return
+		return DisksResponse{}, fmt.Errorf("Error: %v", err)
+	}
+
+	response, err := checkDisks(cfg)
+	if err != nil {
+		return DisksResponse{}, fmt.Errorf("Error evaluating mounts: %v", err)
+	}
+
+	return response, nil
+}
+
+// DisksCheck checks the configured filesystems against the mount option rules and usage thresholds
+type DisksCheck struct{}
+
+func init() {
+	Register(DisksCheck{})
+}
+
+func (DisksCheck) Name() string { return "disks" }
+
+func (DisksCheck) Description() string { return "Check mounted filesystems against the disk rules" }
+
+func (DisksCheck) Run(ctx context.Context) Result {
+	response, err := getDisks(configFrom(ctx))
+	if err == nil {
+		recordDiskMetrics(response)
+	}
+	return Result{State: response.State, Details: response, Err: err}
+}
+
+// Function to export the usage and read-only count of the checked mounts
+func recordDiskMetrics(response DisksResponse) {
+	metrics.DiskUsedRatio.Reset()
+
+	readOnly := 0
+	for _, report := range response.Response {
+		if report.ReadOnly() {
+			readOnly++
+		}
+		if report.Usage != nil {
+			metrics.DiskUsedRatio.WithLabelValues(report.MountPoint, "space").Set(report.Usage.SpaceUsedPercent / 100)
+			metrics.DiskUsedRatio.WithLabelValues(report.MountPoint, "inodes").Set(report.Usage.InodesUsedPercent / 100)
+		}
 	}
-	fmt.Print(response)
+	metrics.DiskReadOnlyMounts.Set(float64(readOnly))
 }
@@ -0,0 +1,52 @@
+package parsers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestThresholdsFor(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(strings.NewReader(`
+disks:
+  thresholds:
+    space: {warning: 80, critical: 90}
+    inodes: {warning: 85, critical: 95}
+  overrides:
+    - mountpoint: /var/log
+      space: {warning: 70, critical: 85}
+    - mountpoint: /srv/*
+      space: {warning: 60}
+    - mountpoint: /scratch
+      inodes: {warning: 0}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadDiskConfig(v)
+	if err != nil {
+		t.Fatalf("loadDiskConfig: %v", err)
+	}
+
+	tests := []struct {
+		mountpoint string
+		want       DiskThresholds
+	}{
+		{"/", DiskThresholds{Space: Threshold{80, 90}, Inodes: Threshold{85, 95}}},
+		{"/var/log", DiskThresholds{Space: Threshold{70, 85}, Inodes: Threshold{85, 95}}},
+		{"/srv/data", DiskThresholds{Space: Threshold{60, 90}, Inodes: Threshold{85, 95}}},
+		{"/scratch", DiskThresholds{Space: Threshold{80, 90}, Inodes: Threshold{0, 95}}},
+	}
+	for _, tt := range tests {
+		got, err := thresholdsFor(cfg, tt.mountpoint)
+		if err != nil {
+			t.Fatalf("thresholdsFor(%q): %v", tt.mountpoint, err)
+		}
+		if got != tt.want {
+			t.Errorf("thresholdsFor(%q) = %+v, want %+v", tt.mountpoint, got, tt.want)
+		}
+	}
+}
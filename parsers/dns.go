@@ -1,52 +1,203 @@
 package parsers
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
-	"os/exec"
+	"strings"
+	"time"
 
-	"github.com/shadowbq/simple-node-health/helpers"
-	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
+	"github.com/miekg/dns"
+	"github.com/shadowbq/simple-node-health/audit"
+	"github.com/shadowbq/simple-node-health/metrics"
 )
 
-// Function to run `dig <domain>` and return the result
-func getDNS(domain string) (string, error) {
-	cmd := exec.Command("dig", "+short", domain)
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("Error executing dig command: %v", err)
+// DefaultResolvConf is where the nameservers are read from when none are configured
+const DefaultResolvConf = "/etc/resolv.conf"
+
+// DNSQuery describes a single lookup made by the DNS check
+type DNSQuery struct {
+	Name    string
+	Type    string        // A, AAAA, MX, TXT, SRV or CNAME
+	Servers []string      // host or host:port, tried in order
+	Timeout time.Duration // per server
+}
+
+// DNSResponse is the answer to a single DNS query
+type DNSResponse struct {
+	Response  []string `json:"response"`        // Records of the queried type
+	Chain     []string `json:"chain,omitempty"` // CNAME targets followed to the answer
+	Query     string   `json:"query"`
+	Type      string   `json:"type"`
+	Server    string   `json:"server"`
+	Rcode     string   `json:"rcode"`
+	LatencyMS float64  `json:"latency_ms"`
+	State     State    `json:"state"`
+}
+
+// Function to resolve a record type name to its query type
+func parseRecordType(name string) (uint16, error) {
+	switch t := strings.ToUpper(name); t {
+	case "A", "AAAA", "MX", "TXT", "SRV", "CNAME":
+		return dns.StringToType[t], nil
+	default:
+		return 0, fmt.Errorf("unsupported record type %q", name)
 	}
+}
 
-	jsonOutput, err := helpers.MultiLineStringToJSON(string(output))
+// Function to add the default DNS port to servers given without one
+func normalizeServer(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), "53")
+}
 
+// Function to read the system nameservers from a resolv.conf file
+func systemServers(resolvConf string) ([]string, error) {
+	cfg, err := dns.ClientConfigFromFile(resolvConf)
 	if err != nil {
-		return "", fmt.Errorf("Error: %v", err)
+		return nil, fmt.Errorf("reading %s: %v", resolvConf, err)
 	}
 
-	return string(jsonOutput), nil
+	servers := make([]string, 0, len(cfg.Servers))
+	for _, server := range cfg.Servers {
+		servers = append(servers, net.JoinHostPort(server, cfg.Port))
+	}
+	return servers, nil
 }
 
-// Function to call getDNS and return the result
-func HTTPCheckDNS(w http.ResponseWriter, r *http.Request) {
-	domain := viper.GetString("domain")
-	result, err := getDNS(domain)
+// Function to format an answer record the way `dig +short` does
+func formatAnswer(rr dns.RR) string {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A.String()
+	case *dns.AAAA:
+		return v.AAAA.String()
+	case *dns.CNAME:
+		return v.Target
+	case *dns.MX:
+		return fmt.Sprintf("%d %s", v.Preference, v.Mx)
+	case *dns.TXT:
+		return strings.Join(v.Txt, "")
+	case *dns.SRV:
+		return fmt.Sprintf("%d %d %d %s", v.Priority, v.Weight, v.Port, v.Target)
+	default:
+		return strings.TrimPrefix(rr.String(), rr.Header().String())
+	}
+}
+
+// Function to query the servers in order and return the first answer, the check
+// fails unless the server answers NOERROR with at least one record of the type
+func queryDNS(ctx context.Context, query DNSQuery) (DNSResponse, error) {
+	qtype, err := parseRecordType(query.Type)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error checking DNS: %v\n", err), http.StatusInternalServerError)
-		return
+		return DNSResponse{}, err
+	}
+	if len(query.Servers) == 0 {
+		return DNSResponse{}, fmt.Errorf("no nameservers configured")
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(query.Name), qtype)
+
+	client := &dns.Client{Timeout: query.Timeout}
+	var lastErr error
+	for _, server := range query.Servers {
+		server = normalizeServer(server)
+
+		reply, rtt, err := client.ExchangeContext(ctx, msg, server)
+		if err == nil && reply.Truncated {
+			// Retry over TCP when the answer did not fit in a UDP packet
+			tcpClient := &dns.Client{Net: "tcp", Timeout: query.Timeout}
+			reply, rtt, err = tcpClient.ExchangeContext(ctx, msg, server)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("querying %s: %v", server, err)
+			continue
+		}
+
+		response := DNSResponse{
+			Response:  []string{},
+			Query:     query.Name,
+			Type:      dns.TypeToString[qtype],
+			Server:    server,
+			Rcode:     dns.RcodeToString[reply.Rcode],
+			LatencyMS: float64(rtt.Microseconds()) / 1000,
+			State:     StatePass,
+		}
+		// A CNAME chain alone is no answer, e.g. a CDN name whose target does not resolve
+		for _, rr := range reply.Answer {
+			switch rr.Header().Rrtype {
+			case qtype:
+				response.Response = append(response.Response, formatAnswer(rr))
+			case dns.TypeCNAME:
+				response.Chain = append(response.Chain, formatAnswer(rr))
+			}
+		}
+		if reply.Rcode != dns.RcodeSuccess || len(response.Response) == 0 {
+			response.State = StateFail
+		}
+		return response, nil
+	}
+
+	return DNSResponse{}, lastErr
+}
+
+// DNSCheck runs the DNS probes, a nil probe list runs the configured probes
+type DNSCheck struct {
+	probes []DNSProbe
+}
+
+func init() {
+	Register(DNSCheck{})
+}
+
+func (DNSCheck) Name() string { return "dns" }
+
+func (DNSCheck) Description() string { return "Run the configured DNS probes" }
+
+func (c DNSCheck) Run(ctx context.Context) Result {
+	probes := c.probes
+	if probes == nil {
+		var err error
+		if probes, err = loadDNSProbes(configFrom(ctx)); err != nil {
+			return Result{State: StateFail, Err: err}
+		}
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprintln(w, result)
+	response := runDNSProbes(ctx, probes)
+	// Lookups from a request are not recorded, their ad-hoc domains would mask or
+	// trigger the alerts of the configured probes
+	if c.probes == nil {
+		recordDNSMetrics(response)
+	}
+	return Result{State: response.State, Details: response}
 }
 
-// Function to print check DNS to console
-func CmdCheckDNS(cmd *cobra.Command, args []string) {
-	domain := viper.GetString("domain")
-	response, err := getDNS(domain)
+// Function to export the latency of the probes that were answered
+func recordDNSMetrics(response DNSChecksResponse) {
+	for _, result := range response.Probes {
+		if result.Error == "" {
+			metrics.DNSLatency.WithLabelValues(result.Name).Observe(result.LatencyMS / 1000)
+		}
+	}
+}
+
+// FromRequest replaces the configured probes with a single lookup when the
+// `domain` or `type` query parameters are set
+func (DNSCheck) FromRequest(r *http.Request) (Check, int, error) {
+	if !r.URL.Query().Has("domain") && !r.URL.Query().Has("type") {
+		return nil, http.StatusOK, nil
+	}
+
+	probe, status, err := dnsOverrideProbe(r)
 	if err != nil {
-		fmt.Println("Error checking DNS:", err)
-		return
+		audit.AuditLog(fmt.Sprintf("DNS override rejected: %v from %s at %s", err, audit.RequestSource(r), time.Now().Format(time.RFC3339)))
+		return nil, status, err
 	}
-	fmt.Print(response)
+	audit.AuditLog(fmt.Sprintf("DNS override: %s %s from %s at %s", probe.Query, probe.Type, audit.RequestSource(r), time.Now().Format(time.RFC3339)))
+
+	return DNSCheck{probes: []DNSProbe{probe}}, http.StatusOK, nil
 }
@@ -0,0 +1,250 @@
+package parsers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// DNSExpect are the optional assertions a probe makes about its answer
+type DNSExpect struct {
+	Contains   []string      `mapstructure:"contains"`    // Every value must be in the answer set
+	Match      string        `mapstructure:"match"`       // Every answer must match the regex
+	MinAnswers int           `mapstructure:"min_answers"` // Minimum number of answers
+	MaxLatency time.Duration `mapstructure:"max_latency"` // Slowest acceptable response
+}
+
+// DNSProbe is one entry of the `dns.probes` config list
+type DNSProbe struct {
+	Name    string        `mapstructure:"name"`
+	Query   string        `mapstructure:"query"`
+	Type    string        `mapstructure:"type"`
+	Server  string        `mapstructure:"server"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	Expect  DNSExpect     `mapstructure:"expect"`
+}
+
+// DNSProbeResult is the answer to a probe and the expectations it failed
+type DNSProbeResult struct {
+	Name string `json:"name"`
+	DNSResponse
+	Failures []string `json:"failures"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// DNSChecksResponse is the JSON document returned by the DNS check
+type DNSChecksResponse struct {
+	Probes []DNSProbeResult `json:"probes"`
+	State  State            `json:"state"`
+}
+
+// Function to load the DNS probes from the config, falling back to a single
+// probe for `domain` when no probes are configured
+func loadDNSProbes(v *viper.Viper) ([]DNSProbe, error) {
+	var probes []DNSProbe
+	if err := v.UnmarshalKey("dns.probes", &probes); err != nil {
+		return nil, fmt.Errorf("parsing dns probes: %v", err)
+	}
+
+	if len(probes) == 0 {
+		probes = []DNSProbe{{Name: "default", Query: v.GetString("domain")}}
+	}
+
+	for i := range probes {
+		probe := &probes[i]
+		if probe.Query == "" {
+			return nil, fmt.Errorf("dns probe %d has no query", i)
+		}
+		if probe.Name == "" {
+			probe.Name = probe.Query
+		}
+		if probe.Type == "" {
+			probe.Type = v.GetString("dns.type")
+		}
+		if probe.Timeout == 0 {
+			probe.Timeout = v.GetDuration("dns.timeout")
+		}
+		if _, err := parseRecordType(probe.Type); err != nil {
+			return nil, fmt.Errorf("dns probe %q: %v", probe.Name, err)
+		}
+		if probe.Expect.Match != "" {
+			if _, err := regexp.Compile(probe.Expect.Match); err != nil {
+				return nil, fmt.Errorf("dns probe %q: invalid match pattern: %v", probe.Name, err)
+			}
+		}
+	}
+
+	return probes, nil
+}
+
+// Function to build the query for a probe, a probe without a server uses the configured resolvers
+func (probe DNSProbe) query(v *viper.Viper) (DNSQuery, error) {
+	query := DNSQuery{
+		Name:    probe.Query,
+		Type:    probe.Type,
+		Servers: []string{probe.Server},
+		Timeout: probe.Timeout,
+	}
+
+	if probe.Server == "" {
+		query.Servers = v.GetStringSlice("dns.servers")
+		if len(query.Servers) == 0 {
+			servers, err := systemServers(v.GetString("dns.resolv_conf"))
+			if err != nil {
+				return query, err
+			}
+			query.Servers = servers
+		}
+	}
+
+	return query, nil
+}
+
+// Function to check an answer against the probe expectations and list what failed
+func (expect DNSExpect) evaluate(response DNSResponse) []string {
+	failures := []string{}
+
+	for _, want := range expect.Contains {
+		found := false
+		for _, answer := range response.Response {
+			if answerEqual(answer, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			failures = append(failures, fmt.Sprintf("answer does not contain %s", want))
+		}
+	}
+
+	if expect.Match != "" {
+		pattern := regexp.MustCompile(expect.Match)
+		for _, answer := range response.Response {
+			if !pattern.MatchString(answer) {
+				failures = append(failures, fmt.Sprintf("answer %s does not match %s", answer, expect.Match))
+			}
+		}
+	}
+
+	if expect.MinAnswers > 0 && len(response.Response) < expect.MinAnswers {
+		failures = append(failures, fmt.Sprintf("%d answers, expected at least %d", len(response.Response), expect.MinAnswers))
+	}
+
+	if expect.MaxLatency > 0 && response.LatencyMS > float64(expect.MaxLatency.Microseconds())/1000 {
+		failures = append(failures, fmt.Sprintf("latency %.3fms exceeds %s", response.LatencyMS, expect.MaxLatency))
+	}
+
+	return failures
+}
+
+// Function to compare answers, IP addresses are compared in their canonical form
+func answerEqual(answer, want string) bool {
+	if a, w := net.ParseIP(answer), net.ParseIP(want); a != nil && w != nil {
+		return a.Equal(w)
+	}
+	return answer == want
+}
+
+// Function to run a single probe
+func runDNSProbe(ctx context.Context, probe DNSProbe) DNSProbeResult {
+	result := DNSProbeResult{Name: probe.Name, Failures: []string{}}
+
+	query, err := probe.query(configFrom(ctx))
+	if err == nil {
+		result.DNSResponse, err = queryDNS(ctx, query)
+	}
+	if err != nil {
+		result.Query = probe.Query
+		result.Type = probe.Type
+		result.State = StateFail
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Failures = probe.Expect.evaluate(result.DNSResponse)
+	if len(result.Failures) > 0 {
+		result.State = StateFail
+	}
+
+	return result
+}
+
+// Function to run every probe concurrently, the check fails when any probe fails
+func runDNSProbes(ctx context.Context, probes []DNSProbe) DNSChecksResponse {
+	response := DNSChecksResponse{Probes: make([]DNSProbeResult, len(probes)), State: StatePass}
+
+	var wg sync.WaitGroup
+	for i, probe := range probes {
+		wg.Add(1)
+		go func(i int, probe DNSProbe) {
+			defer wg.Done()
+			response.Probes[i] = runDNSProbe(ctx, probe)
+		}(i, probe)
+	}
+	wg.Wait()
+
+	for _, result := range response.Probes {
+		response.State = worstState(response.State, result.State)
+	}
+
+	return response
+}
+
+// Function to build a probe from the `domain` and `type` query parameters of a
+// request. The domain must be on the `dns.allow` list so the endpoint cannot be
+// used as an open resolver; the returned status is the HTTP code for a rejection.
+func dnsOverrideProbe(r *http.Request) (DNSProbe, int, error) {
+	cfg := currentConfig()
+	probe := DNSProbe{
+		Name:    "override",
+		Query:   strings.TrimSuffix(strings.ToLower(r.URL.Query().Get("domain")), "."),
+		Type:    strings.ToUpper(r.URL.Query().Get("type")),
+		Timeout: cfg.GetDuration("dns.timeout"),
+	}
+	if probe.Query == "" {
+		probe.Query = cfg.GetString("domain")
+	}
+	if probe.Type == "" {
+		probe.Type = cfg.GetString("dns.type")
+	}
+
+	if _, ok := dns.IsDomainName(probe.Query); !ok {
+		return probe, http.StatusBadRequest, fmt.Errorf("invalid domain %q", probe.Query)
+	}
+	if _, err := parseRecordType(probe.Type); err != nil {
+		return probe, http.StatusBadRequest, err
+	}
+	if !dnsDomainAllowed(probe.Query, cfg.GetStringSlice("dns.allow")) {
+		return probe, http.StatusForbidden, fmt.Errorf("domain %q is not on the dns allow list", probe.Query)
+	}
+
+	return probe, http.StatusOK, nil
+}
+
+// Function to match a domain against the allow list. An entry matches the
+// domain exactly, an entry starting with "." or "*." matches its subdomains.
+func dnsDomainAllowed(domain string, allow []string) bool {
+	for _, entry := range allow {
+		entry = strings.TrimSuffix(strings.ToLower(entry), ".")
+		if suffix, ok := strings.CutPrefix(entry, "*"); ok {
+			entry = suffix
+		}
+
+		if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(domain, entry) {
+				return true
+			}
+		} else if domain == entry {
+			return true
+		}
+	}
+	return false
+}
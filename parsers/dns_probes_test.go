@@ -0,0 +1,31 @@
+package parsers
+
+import "testing"
+
+func TestDNSDomainAllowed(t *testing.T) {
+	tests := []struct {
+		domain string
+		allow  []string
+		want   bool
+	}{
+		{"example.com", []string{"example.com"}, true},
+		{"example.com", []string{"Example.COM."}, true},
+		{"www.example.com", []string{"example.com"}, false},
+		{"example.com", []string{".example.com"}, false},
+		{"www.example.com", []string{".example.com"}, true},
+		{"a.b.example.com", []string{".example.com"}, true},
+		{"example.com", []string{"*.example.com"}, false},
+		{"www.example.com", []string{"*.example.com"}, true},
+		{"badexample.com", []string{"example.com"}, false},
+		{"badexample.com", []string{".example.com"}, false},
+		{"badexample.com", []string{"*.example.com"}, false},
+		{"example.com.evil.test", []string{"example.com", ".example.com"}, false},
+		{"example.com", []string{"other.test", "example.com"}, true},
+		{"example.com", nil, false},
+	}
+	for _, tt := range tests {
+		if got := dnsDomainAllowed(tt.domain, tt.allow); got != tt.want {
+			t.Errorf("dnsDomainAllowed(%q, %q) = %v, want %v", tt.domain, tt.allow, got, tt.want)
+		}
+	}
+}
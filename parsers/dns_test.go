@@ -0,0 +1,142 @@
+package parsers
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Function to answer the test zone: ok. has an A record, nx. does not exist,
+// big. is truncated over UDP and answered over TCP, cdn. is a CNAME to an A
+// record, dangling. a CNAME without one, and slow. is never answered
+func testDNSHandler(w dns.ResponseWriter, req *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	name := req.Question[0].Name
+	a := func(ip string) dns.RR {
+		rr, _ := dns.NewRR(name + " 60 IN A " + ip)
+		return rr
+	}
+	cname := func(target string) dns.RR {
+		rr, _ := dns.NewRR(name + " 60 IN CNAME " + target)
+		return rr
+	}
+
+	switch name {
+	case "ok.test.":
+		reply.Answer = append(reply.Answer, a("192.0.2.1"))
+	case "nx.test.":
+		reply.SetRcode(req, dns.RcodeNameError)
+	case "big.test.":
+		if w.RemoteAddr().Network() == "tcp" {
+			reply.Answer = append(reply.Answer, a("192.0.2.2"), a("192.0.2.3"))
+		} else {
+			reply.Truncated = true
+		}
+	case "cdn.test.":
+		edge, _ := dns.NewRR("edge.cdn.example. 60 IN A 192.0.2.4")
+		reply.Answer = append(reply.Answer, cname("edge.cdn.example."), edge)
+	case "dangling.test.":
+		reply.Answer = append(reply.Answer, cname("gone.cdn.example."))
+	case "slow.test.":
+		return
+	}
+	w.WriteMsg(reply)
+}
+
+// Function to start a UDP and TCP server on the same port of 127.0.0.1
+func startTestDNSServer(t *testing.T) string {
+	t.Helper()
+
+	for attempt := 0; attempt < 10; attempt++ {
+		packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+		if err != nil {
+			packetConn.Close()
+			continue
+		}
+
+		handler := dns.HandlerFunc(testDNSHandler)
+		for _, server := range []*dns.Server{{PacketConn: packetConn, Handler: handler}, {Listener: listener, Handler: handler}} {
+			started := make(chan struct{})
+			server.NotifyStartedFunc = func() { close(started) }
+			go server.ActivateAndServe()
+			<-started
+			t.Cleanup(func() { server.Shutdown() })
+		}
+		return packetConn.LocalAddr().String()
+	}
+	t.Fatal("no free port for both UDP and TCP")
+	return ""
+}
+
+func TestQueryDNS(t *testing.T) {
+	server := startTestDNSServer(t)
+
+	tests := []struct {
+		name     string
+		query    string
+		state    State
+		rcode    string
+		response []string
+		chain    []string
+	}{
+		{"answer", "ok.test", StatePass, "NOERROR", []string{"192.0.2.1"}, nil},
+		{"nxdomain", "nx.test", StateFail, "NXDOMAIN", []string{}, nil},
+		{"truncated then tcp", "big.test", StatePass, "NOERROR", []string{"192.0.2.2", "192.0.2.3"}, nil},
+		{"cname chain", "cdn.test", StatePass, "NOERROR", []string{"192.0.2.4"}, []string{"edge.cdn.example."}},
+		{"dangling cname", "dangling.test", StateFail, "NOERROR", []string{}, []string{"gone.cdn.example."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := queryDNS(context.Background(), DNSQuery{Name: tt.query, Type: "A", Servers: []string{server}, Timeout: time.Second})
+			if err != nil {
+				t.Fatalf("queryDNS: %v", err)
+			}
+			if response.State != tt.state || response.Rcode != tt.rcode || !reflect.DeepEqual(response.Response, tt.response) {
+				t.Errorf("got state %s rcode %s answers %q, want %s %s %q", response.State, response.Rcode, response.Response, tt.state, tt.rcode, tt.response)
+			}
+			if !reflect.DeepEqual(response.Chain, tt.chain) {
+				t.Errorf("got chain %q, want %q", response.Chain, tt.chain)
+			}
+			if response.Server != server {
+				t.Errorf("answered by %s, want %s", response.Server, server)
+			}
+		})
+	}
+}
+
+func TestQueryDNSTimeout(t *testing.T) {
+	server := startTestDNSServer(t)
+
+	start := time.Now()
+	_, err := queryDNS(context.Background(), DNSQuery{Name: "slow.test", Type: "A", Servers: []string{server}, Timeout: 200 * time.Millisecond})
+	if err == nil {
+		t.Fatal("queryDNS of an unanswered query succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timed out after %s, want about 200ms", elapsed)
+	}
+
+	// A server that does not answer is skipped for the next one
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	response, err := queryDNS(context.Background(), DNSQuery{Name: "ok.test", Type: "A", Servers: []string{silent.LocalAddr().String(), server}, Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("queryDNS with a silent first server: %v", err)
+	}
+	if response.Server != server || response.State != StatePass {
+		t.Errorf("answered by %s with state %s, want %s and pass", response.Server, response.State, server)
+	}
+}
@@ -0,0 +1,152 @@
+package parsers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultMountInfoPath is the mount table read by the disk check unless overridden in config
+const DefaultMountInfoPath = "/proc/self/mountinfo"
+
+// Mount is a single record from a mountinfo table (see proc(5))
+type Mount struct {
+	MountID      int      `json:"mount_id"`
+	ParentID     int      `json:"parent_id"`
+	MajorMinor   string   `json:"major_minor"`
+	Root         string   `json:"root"`
+	MountPoint   string   `json:"mountpoint"`
+	Options      []string `json:"options"`
+	FSType       string   `json:"fstype"`
+	Device       string   `json:"device"`
+	SuperOptions []string `json:"super_options"`
+}
+
+// HasOption reports whether the option is set on the mount, either as a
+// per-mount option or as a superblock option (e.g. "ro" or "errors=remount-ro")
+func (m Mount) HasOption(option string) bool {
+	for _, o := range m.Options {
+		if o == option {
+			return true
+		}
+	}
+	for _, o := range m.SuperOptions {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadOnly reports whether the mount or its superblock is read-only
+func (m Mount) ReadOnly() bool {
+	return m.HasOption("ro")
+}
+
+// ReadMountInfo opens and parses the mountinfo file at path
+func ReadMountInfo(path string) ([]Mount, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening mount table: %v", err)
+	}
+	defer file.Close()
+
+	return ParseMountInfo(file)
+}
+
+// ParseMountInfo parses mountinfo formatted records, one per line:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func ParseMountInfo(r io.Reader) ([]Mount, error) {
+	var mounts []Mount
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		mount, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("mount table line %d: %v", lineNo, err)
+		}
+		mounts = append(mounts, mount)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading mount table: %v", err)
+	}
+
+	return mounts, nil
+}
+
+// parseMountInfoLine parses a single mountinfo record
+func parseMountInfoLine(line string) (Mount, error) {
+	fields := strings.Fields(line)
+
+	// The optional fields are variable length and terminated by a lone "-"
+	separator := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			separator = i
+			break
+		}
+	}
+	if len(fields) < 6 || separator == -1 || len(fields) < separator+3 {
+		return Mount{}, fmt.Errorf("malformed record %q", line)
+	}
+
+	mountID, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Mount{}, fmt.Errorf("invalid mount id %q", fields[0])
+	}
+	parentID, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Mount{}, fmt.Errorf("invalid parent id %q", fields[1])
+	}
+	if !strings.Contains(fields[2], ":") {
+		return Mount{}, fmt.Errorf("invalid major:minor %q", fields[2])
+	}
+
+	mount := Mount{
+		MountID:    mountID,
+		ParentID:   parentID,
+		MajorMinor: fields[2],
+		Root:       unescapeMountField(fields[3]),
+		MountPoint: unescapeMountField(fields[4]),
+		Options:    strings.Split(fields[5], ","),
+		FSType:     fields[separator+1],
+		Device:     unescapeMountField(fields[separator+2]),
+	}
+	if len(fields) > separator+3 {
+		mount.SuperOptions = strings.Split(fields[separator+3], ",")
+	}
+
+	return mount, nil
+}
+
+// unescapeMountField decodes the octal escapes (\040 for space, \011 for tab,
+// \012 for newline, \134 for backslash) the kernel uses in path fields
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if v, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(field[i])
+	}
+	return sb.String()
+}
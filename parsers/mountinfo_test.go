@@ -0,0 +1,88 @@
+package parsers
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	file, err := os.Open("testdata/mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	mounts, err := ParseMountInfo(file)
+	if err != nil {
+		t.Fatalf("ParseMountInfo: %v", err)
+	}
+
+	want := []struct {
+		mountPoint string
+		root       string
+		device     string
+		fsType     string
+		readOnly   bool
+	}{
+		{"/", "/", "/dev/vda", "ext4", false},
+		{"/data", "/", "/dev/vdb", "ext4", false},
+		{"/srv/archive", "/", "/dev/vdc", "xfs", true},                     // ro as the last mount option
+		{"/home", "/exports/home", "/dev/vdb", "ext4", false},              // bind mount of a subdirectory
+		{"/mnt/My Disk", "/", "/dev/disk/by-label/My Disk", "ext4", false}, // \040 escapes
+		{"/mnt/tab\tand\\slash", "/", "tmp fs", "tmpfs", true},             // ro as the last superblock option
+	}
+	if len(mounts) != len(want) {
+		t.Fatalf("got %d mounts, want %d", len(mounts), len(want))
+	}
+	for i, w := range want {
+		m := mounts[i]
+		if m.MountPoint != w.mountPoint || m.Root != w.root || m.Device != w.device || m.FSType != w.fsType || m.ReadOnly() != w.readOnly {
+			t.Errorf("mount %d = {%q %q %q %q ro=%t}, want %+v", i, m.MountPoint, m.Root, m.Device, m.FSType, m.ReadOnly(), w)
+		}
+	}
+
+	if got := mounts[1].SuperOptions; !reflect.DeepEqual(got, []string{"rw", "errors=remount-ro"}) {
+		t.Errorf("super options = %q", got)
+	}
+	if mounts[1].ReadOnly() {
+		t.Error("errors=remount-ro must not make a mount read-only")
+	}
+	if mounts[3].MajorMinor != mounts[1].MajorMinor {
+		t.Errorf("bind mount major:minor %s, want %s", mounts[3].MajorMinor, mounts[1].MajorMinor)
+	}
+}
+
+func TestParseMountInfoMalformed(t *testing.T) {
+	for _, line := range []string{
+		"22 1 254:0 / / rw,relatime shared:1 ext4 /dev/vda rw",
+		"x 1 254:0 / / rw - ext4 /dev/vda rw",
+		"22 1 2540 / / rw - ext4 /dev/vda rw",
+		"22 1 254:0 / / rw -",
+	} {
+		if _, err := ParseMountInfo(strings.NewReader(line)); err == nil {
+			t.Errorf("ParseMountInfo(%q) succeeded, want an error", line)
+		}
+	}
+}
+
+func TestUnescapeMountField(t *testing.T) {
+	tests := []struct {
+		field, want string
+	}{
+		{"/plain", "/plain"},
+		{`/mnt/My\040Disk`, "/mnt/My Disk"},
+		{`/a\011b`, "/a\tb"},
+		{`/a\012b`, "/a\nb"},
+		{`/back\134slash`, `/back\slash`},
+		{`/end\040`, "/end "},
+		{`/short\04`, `/short\04`},
+		{`/not\999octal`, `/not\999octal`},
+	}
+	for _, tt := range tests {
+		if got := unescapeMountField(tt.field); got != tt.want {
+			t.Errorf("unescapeMountField(%q) = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
@@ -1,31 +1,38 @@
 package parsers
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"net/http"
-
-	"github.com/spf13/cobra"
 )
 
-func getStatus() map[string]string {
-	return map[string]string{"status": "ok"}
+// StatusResponse is the JSON document returned by the status check
+type StatusResponse struct {
+	Status string `json:"status"`
+	State  State  `json:"state"`
 }
 
-// Function to return JSON status
-func HTTPCheckStatus(w http.ResponseWriter, r *http.Request) {
+// StatusCheck reports that the service is up
+type StatusCheck struct{}
+
+func init() {
+	Register(StatusCheck{})
+}
+
+func (StatusCheck) Name() string { return "status" }
+
+func (StatusCheck) Description() string { return "Check the service status" }
+
+func (StatusCheck) Run(ctx context.Context) Result {
 	response := getStatus()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return Result{State: response.State, Details: response}
 }
 
-// Function to print check status to console
-func CmdCheckStatus(cmd *cobra.Command, args []string) {
+func getStatus() StatusResponse {
+	return StatusResponse{Status: "ok", State: StatePass}
+}
+
+// Function to return JSON status, used for the liveness route
+func HTTPCheckStatus(w http.ResponseWriter, r *http.Request) {
 	response := getStatus()
-	output, err := json.Marshal(response)
-	if err != nil {
-		fmt.Println("Error encoding response:", err)
-		return
-	}
-	fmt.Println(string(output))
+	writeCheckResponse(w, response.State, response)
 }
@@ -0,0 +1,133 @@
+package parsers
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// scheduledCheck is a check run in the background on an interval, requests are served its cached result
+type scheduledCheck struct {
+	check    Check
+	interval time.Duration
+
+	runMu sync.Mutex // serializes background and forced runs
+
+	mu     sync.RWMutex
+	result CheckResult
+	ran    bool
+}
+
+var (
+	schedulerMu     sync.RWMutex
+	scheduled       = map[string]*scheduledCheck{}
+	schedulerCancel context.CancelFunc
+)
+
+// StartScheduler runs every enabled check with a `checks.<name>.interval` in the
+// background. Checks without an interval keep running on every request.
+func StartScheduler() {
+	StopScheduler()
+
+	schedulerMu.Lock()
+	defer schedulerMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	schedulerCancel = cancel
+	scheduled = map[string]*scheduledCheck{}
+
+	cfg := currentConfig()
+	for _, check := range Checks() {
+		interval := cfg.GetDuration("checks." + check.Name() + ".interval")
+		if !cfg.GetBool("checks."+check.Name()+".enabled") || interval <= 0 {
+			continue
+		}
+
+		sc := &scheduledCheck{check: check, interval: interval}
+		scheduled[check.Name()] = sc
+		go sc.loop(ctx)
+		log.Printf("Scheduled check %s every %s", check.Name(), interval)
+	}
+}
+
+// StopScheduler stops the background runs and drops the cached results
+func StopScheduler() {
+	schedulerMu.Lock()
+	defer schedulerMu.Unlock()
+
+	if schedulerCancel != nil {
+		schedulerCancel()
+		schedulerCancel = nil
+	}
+	scheduled = map[string]*scheduledCheck{}
+}
+
+// Function to run the check immediately and then on every tick until the scheduler stops
+func (sc *scheduledCheck) loop(ctx context.Context) {
+	ticker := time.NewTicker(sc.interval)
+	defer ticker.Stop()
+
+	for {
+		sc.run(ctx, 0)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Function to run the check and cache its result. Callers that waited for a run
+// in progress get its result when it is younger than maxAge instead of running again.
+func (sc *scheduledCheck) run(ctx context.Context, maxAge time.Duration) CheckResult {
+	sc.runMu.Lock()
+	defer sc.runMu.Unlock()
+
+	if result, ok := sc.cached(); ok && result.AgeSeconds < maxAge.Seconds() {
+		return result
+	}
+	result := runCheck(ctx, sc.check)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.result = result
+	sc.ran = true
+	return result
+}
+
+// Function to return the cached result, aged to now
+func (sc *scheduledCheck) cached() (CheckResult, bool) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+
+	result := sc.result
+	result.AgeSeconds = math.Round(time.Since(result.LastRun).Seconds()*1000) / 1000
+	return result, sc.ran
+}
+
+// Function to get the result of a check: the cached result for a scheduled
+// check, otherwise a new run. A fresh request forces a run of a scheduled check
+// unless it last ran within `checks.fresh_min_interval`.
+func resultFor(ctx context.Context, check Check, fresh bool) CheckResult {
+	schedulerMu.RLock()
+	sc := scheduled[check.Name()]
+	schedulerMu.RUnlock()
+
+	if sc == nil {
+		return runCheck(ctx, check)
+	}
+
+	// A forced run outlives the request so a disconnecting client does not poison the cache
+	minInterval := currentConfig().GetDuration("checks.fresh_min_interval")
+	result, ok := sc.cached()
+	if !ok {
+		// Any result will do, also one of a run that finished while waiting
+		return sc.run(context.WithoutCancel(ctx), time.Duration(math.MaxInt64))
+	}
+	if fresh && result.AgeSeconds >= minInterval.Seconds() {
+		return sc.run(context.WithoutCancel(ctx), minInterval)
+	}
+	return result
+}
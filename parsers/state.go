@@ -0,0 +1,77 @@
+package parsers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// State is the pass/warn/fail verdict of a check
+type State string
+
+const (
+	StatePass State = "pass"
+	StateWarn State = "warn"
+	StateFail State = "fail"
+)
+
+// DefaultHTTPStatus maps each state to the HTTP status code returned when the config does not override it
+var DefaultHTTPStatus = map[State]int{
+	StatePass: http.StatusOK,
+	StateWarn: http.StatusOK,
+	StateFail: http.StatusServiceUnavailable,
+}
+
+// stateSeverity orders the states from healthy to failed
+var stateSeverity = map[State]int{StatePass: 0, StateWarn: 1, StateFail: 2}
+
+// Function to return the more severe of two states
+func worstState(a, b State) State {
+	if stateSeverity[b] > stateSeverity[a] {
+		return b
+	}
+	return a
+}
+
+// ErrorResponse is the JSON document returned when a check could not run
+type ErrorResponse struct {
+	State State  `json:"state"`
+	Error string `json:"error"`
+}
+
+// HTTPStatus returns the configured HTTP status code for a state (`http_status.<state>`)
+func HTTPStatus(state State) int {
+	if code := currentConfig().GetInt("http_status." + string(state)); code > 0 {
+		return code
+	}
+	return DefaultHTTPStatus[state]
+}
+
+// Function to write a check response with the status code mapped from its state
+func writeCheckResponse(w http.ResponseWriter, state State, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(HTTPStatus(state))
+	json.NewEncoder(w).Encode(response)
+}
+
+// Function to write a check that failed to run as a failed state
+func writeCheckError(w http.ResponseWriter, err error) {
+	writeCheckResponse(w, StateFail, ErrorResponse{State: StateFail, Error: err.Error()})
+}
+
+// Function to write a request that was rejected before the check ran
+func writeRequestError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{State: StateFail, Error: err.Error()})
+}
+
+// Function to print a check response to the console
+func printCheckResponse(response interface{}) {
+	output, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		fmt.Println("Error encoding response:", err)
+		return
+	}
+	fmt.Println(string(output))
+}
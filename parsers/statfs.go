@@ -0,0 +1,47 @@
+package parsers
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// DiskUsage is the used space and inode percentages of a mounted filesystem
+type DiskUsage struct {
+	SpaceUsedPercent  float64 `json:"space_used_percent"`
+	InodesUsedPercent float64 `json:"inodes_used_percent"`
+	SizeBytes         uint64  `json:"size_bytes"`
+	AvailableBytes    uint64  `json:"available_bytes"`
+}
+
+// Function to statfs a mountpoint and compute its usage the way df does
+func getDiskUsage(mountpoint string) (DiskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mountpoint, &st); err != nil {
+		return DiskUsage{}, fmt.Errorf("statfs %s: %v", mountpoint, err)
+	}
+
+	// Block counts are in fragments, Bsize is only the preferred I/O size
+	blockSize := uint64(st.Frsize)
+	usage := DiskUsage{
+		SizeBytes:      uint64(st.Blocks) * blockSize,
+		AvailableBytes: uint64(st.Bavail) * blockSize,
+	}
+
+	// Blocks reserved for root are neither used nor available to users
+	used := uint64(st.Blocks) - uint64(st.Bfree)
+	if total := used + uint64(st.Bavail); total > 0 {
+		usage.SpaceUsedPercent = percent(used, total)
+	}
+
+	// Some filesystems (btrfs, zfs) report no fixed inode table
+	if files := uint64(st.Files); files > 0 {
+		usage.InodesUsedPercent = percent(files-uint64(st.Ffree), files)
+	}
+
+	return usage, nil
+}
+
+// Function to compute a percentage rounded to two decimals
+func percent(part, total uint64) float64 {
+	return float64(part*10000/total) / 100
+}
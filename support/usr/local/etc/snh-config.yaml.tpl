@@ -1,4 +1,6 @@
+# Add clients with `simple-node-health client create [--scope ...]`, which appends
+# the client_id and a bcrypt client_secret_hash here and prints the secret once
 clients:
   - client_id: "{{your-client-id}}"
-    client_secret: "{{your-client-secret}}"
-authTokenSecret: "{{your-auth-token-secret}}" # Used to sign JWTs
\ No newline at end of file
+    client_secret_hash: "{{your-client-secret-hash}}"
+authTokenSecret: "{{your-auth-token-secret}}" # Used to sign JWTs